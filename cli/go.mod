@@ -2,10 +2,8 @@ module github.com/vyPal/VFMP/cli
 
 go 1.21.1
 
-require (
-	github.com/Microsoft/go-winio v0.6.1 // indirect
-	github.com/james-barrow/golang-ipc v1.2.4 // indirect
-	golang.org/x/mod v0.10.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
-	golang.org/x/tools v0.9.1 // indirect
-)
+require github.com/vyPal/VFMP/vfmpconfig v0.0.0
+
+require gopkg.in/yaml.v2 v2.4.0 // indirect
+
+replace github.com/vyPal/VFMP/vfmpconfig => ../vfmpconfig
@@ -3,26 +3,19 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"gopkg.in/yaml.v2"
+	"github.com/vyPal/VFMP/vfmpconfig"
 )
 
-type ConfigDatabase struct {
-	Data struct {
-		Dir string `yaml:"dir" default:"/var/lib/vfmp"`
-	} `yaml:"data"`
-	Server struct {
-		Port int `yaml:"port" default:"32768"`
-	}
-}
-
 type IPCMessage struct {
 	Type string `json:"type"`
 	Data string `json:"data"`
@@ -42,39 +35,177 @@ type SearchRequest struct {
 	Dir          string `json:"dir"`
 	SearchString string `json:"search"`
 	FuzzySearch  bool   `json:"fuzzy" default:"false"`
+	Mode         string `json:"mode" default:"exact"`
+	MaxDistance  int    `json:"distance" default:"2"`
 	MinScore     int    `json:"score" default:"0"`
 	MaxResults   int    `json:"max" default:"10"`
 }
 
 type Match struct {
-	Path    string
-	Indexes []int
-	Score   int
+	Path      string
+	Indexes   []int
+	Score     float64
+	Breakdown ScoreBreakdown
 }
 
-func main() {
+type ScoreBreakdown struct {
+	Fuzzy    float64
+	BaseName float64
+	Depth    float64
+	Recency  float64
+	History  float64
+}
+
+type ContentSearchRequest struct {
+	SearchString string `json:"search"`
+	MaxResults   int    `json:"max" default:"10"`
+}
 
-	// Set the path to the config file
-	configFile := filepath.Join("/root", ".config", "vfmp", "config.yaml")
+type ContentMatch struct {
+	Path  string
+	Lines []int
+}
 
-	// Read the config file
-	var config ConfigDatabase
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		log.Fatalf("Failed to read config file: %v", err)
+type DedupeRequest struct {
+	Dirs []string `json:"dirs"`
+}
+
+type DedupeProgress struct {
+	Stage string
+	Done  int
+	Total int
+}
+
+type DuplicateSet struct {
+	Size   int64
+	Hash   string
+	Paths  []string
+	Wasted int64
+}
+
+type DedupeReport struct {
+	Files  int
+	Sets   []DuplicateSet
+	Wasted int64
+}
+
+type UsageRequest struct {
+	Dir   string `json:"dir"`
+	Depth int    `json:"depth" default:"1"`
+	Top   int    `json:"top" default:"10"`
+}
+
+type FileUsage struct {
+	Path string
+	Size int64
+}
+
+type ExtUsage struct {
+	Ext   string
+	Files int
+	Bytes int64
+}
+
+type DirUsage struct {
+	Path       string
+	Files      int
+	Bytes      int64
+	Largest    []FileUsage
+	Extensions []ExtUsage
+	Children   []DirUsage
+}
+
+type RootStatus struct {
+	Path     string
+	Exclude  []string
+	MaxDepth int
+	Symlinks string
+	Schedule string
+	Indexed  time.Time
+	Files    int
+}
+
+type ScheduleStatus struct {
+	Root         string
+	Schedule     string
+	Running      bool
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string
+	NextRun      time.Time
+}
+
+type IndexStatus struct {
+	Name     string
+	File     string
+	Size     int64
+	Modified time.Time
+	Age      time.Duration
+	Loaded   bool
+	Entries  int
+}
+
+type JobStats struct {
+	Count         int64
+	Running       int64
+	TotalDuration time.Duration
+	LastDuration  time.Duration
+}
+
+type LatencyStats struct {
+	Count uint64
+	Sum   time.Duration
+}
+
+type DaemonStats struct {
+	Uptime      time.Duration
+	Connections struct {
+		Open  int64
+		Total int64
+	}
+	Memory struct {
+		Alloc      uint64
+		Sys        uint64
+		NumGC      uint32
+		Goroutines int
 	}
+	Indexes  []IndexStatus
+	Jobs     map[string]JobStats
+	Searches map[string]LatencyStats
+}
+
+type ConfigInfo struct {
+	File   string
+	Config string
+}
+
+type ConfigReload struct {
+	Applied []string
+	Restart []string
+	Reindex bool
+}
+
+type OpenRequest struct {
+	Path string `json:"path"`
+}
+
+type TypoMatch struct {
+	Path     string
+	Distance int
+}
 
-	// Parse the config file
-	err = yaml.Unmarshal(data, &config)
+func main() {
+
+	configFile := flag.String("config", "", "client config `file` to use instead of client.yaml in the user config directory")
+	flag.Parse()
+
+	config, err := vfmpconfig.LoadClient(*configFile)
 	if err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
+		log.Fatalf("Failed to read config file: %v", err)
 	}
 
-	// Set the server address and port
-	serverAddr := fmt.Sprintf("localhost:%d", config.Server.Port)
-
 	// Connect to the server
-	conn, err := net.Dial("tcp", serverAddr)
+	conn, err := net.Dial("tcp", config.Server.Address)
 	if err != nil {
 		fmt.Printf("Failed to connect to server: %v\n", err)
 		return
@@ -104,11 +235,16 @@ func main() {
 				fmt.Println("Error sending count:", err)
 			}
 		case "index":
-			if len(args) != 1 {
-				fmt.Println("count command requires 1 argument")
+			if len(args) > 1 {
+				fmt.Println("index command takes at most 1 argument")
 				continue
 			}
-			err := sendIndex(args[0], conn)
+			// Without a directory every configured root is indexed again.
+			dir := ""
+			if len(args) == 1 {
+				dir = args[0]
+			}
+			err := sendIndex(dir, conn)
 			if err != nil {
 				fmt.Println("Error sending count:", err)
 			}
@@ -117,15 +253,96 @@ func main() {
 				fmt.Println("count command requires 3 arguments")
 				continue
 			}
-			fuz, err := strconv.ParseBool(args[2])
-			if err != nil {
-				fmt.Println("Argument 2 is not bool")
+			// The last argument is either a search mode or true/false for fuzzy search
+			mode := args[2]
+			if fuz, err := strconv.ParseBool(args[2]); err == nil {
+				mode = "exact"
+				if fuz {
+					mode = "fuzzy"
+				}
 			}
-			err = sendSearch(args[0], args[1], fuz, conn)
+			err := sendSearch(args[0], args[1], mode, conn)
 			if err != nil {
 				fmt.Println("Error sending count:", err)
 			}
 			// ... (your other cases)
+		case "query":
+			if len(args) == 0 {
+				fmt.Println("query command requires a query")
+				continue
+			}
+			err := sendSearch("", strings.Join(args, " "), "query", conn)
+			if err != nil {
+				fmt.Println("Error sending query:", err)
+			}
+		case "content":
+			if len(args) == 0 {
+				fmt.Println("content command requires words to search for")
+				continue
+			}
+			err := sendContentSearch(strings.Join(args, " "), conn)
+			if err != nil {
+				fmt.Println("Error sending content search:", err)
+			}
+		case "dedupe":
+			err := sendDedupe(args, conn)
+			if err != nil {
+				fmt.Println("Error sending dedupe:", err)
+			}
+		case "roots":
+			err := sendRoots(conn)
+			if err != nil {
+				fmt.Println("Error sending roots:", err)
+			}
+		case "stats":
+			err := sendStats(conn)
+			if err != nil {
+				fmt.Println("Error sending stats:", err)
+			}
+		case "config":
+			err := sendConfigGet(conn)
+			if err != nil {
+				fmt.Println("Error sending config:", err)
+			}
+		case "reload":
+			err := sendConfigReload(conn)
+			if err != nil {
+				fmt.Println("Error sending reload:", err)
+			}
+		case "schedule":
+			err := sendSchedule(conn)
+			if err != nil {
+				fmt.Println("Error sending schedule:", err)
+			}
+		case "usage":
+			if len(args) > 2 {
+				fmt.Println("usage command takes at most 2 arguments")
+				continue
+			}
+			dir, depth := "", 1
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			if len(args) > 1 {
+				depth, err = strconv.Atoi(args[1])
+				if err != nil {
+					fmt.Println("usage depth must be a number")
+					continue
+				}
+			}
+			err := sendUsage(dir, depth, conn)
+			if err != nil {
+				fmt.Println("Error sending usage:", err)
+			}
+		case "open":
+			if len(args) != 1 {
+				fmt.Println("open command requires 1 argument")
+				continue
+			}
+			err := sendOpen(args[0], conn)
+			if err != nil {
+				fmt.Println("Error sending open:", err)
+			}
 		case "exit":
 			return
 		default:
@@ -218,11 +435,462 @@ func sendIndex(dir string, conn net.Conn) error {
 	}
 }
 
-func sendSearch(path, search string, fuzzy bool, conn net.Conn) error {
+func sendContentSearch(search string, conn net.Conn) error {
+	jsonReq, err := json.Marshal(ContentSearchRequest{SearchString: search, MaxResults: 10})
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "search.content",
+		Data: string(jsonReq),
+	})
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	if json.Unmarshal([]byte(message), &ipcMessage) == nil && ipcMessage.Type == "search.error" {
+		fmt.Println("Search error:", ipcMessage.Data)
+		return nil
+	}
+
+	var matches []ContentMatch
+	err = json.Unmarshal([]byte(message), &matches)
+	if err != nil {
+		fmt.Println("Error decoding matches:", err)
+		return nil
+	}
+	for _, match := range matches {
+		fmt.Println(match.Path, match.Lines)
+	}
+	return nil
+}
+
+func sendDedupe(dirs []string, conn net.Conn) error {
+	jsonReq, err := json.Marshal(DedupeRequest{Dirs: dirs})
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "dedupe",
+		Data: string(jsonReq),
+	})
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Println("Error reading from connection:", err)
+			return nil
+		}
+
+		var ipcMessage IPCMessage
+		err = json.Unmarshal([]byte(message), &ipcMessage)
+		if err != nil {
+			fmt.Println("Error unmarshalling IPCMessage:", err)
+			return nil
+		}
+
+		switch ipcMessage.Type {
+		case "dedupe.progress":
+			var progress DedupeProgress
+			json.Unmarshal([]byte(ipcMessage.Data), &progress)
+			fmt.Printf("Dedupe progress: %s %d/%d files\n", progress.Stage, progress.Done, progress.Total)
+		case "dedupe.error":
+			fmt.Println("Dedupe error:", ipcMessage.Data)
+			return nil
+		case "dedupe.done":
+			var report DedupeReport
+			err = json.Unmarshal([]byte(ipcMessage.Data), &report)
+			if err != nil {
+				fmt.Println("Error decoding report:", err)
+				return nil
+			}
+			for _, set := range report.Sets {
+				fmt.Printf("%d bytes wasted by %d copies:\n", set.Wasted, len(set.Paths))
+				for _, path := range set.Paths {
+					fmt.Println("  ", path)
+				}
+			}
+			fmt.Printf("Dedupe done: %d files checked, %d bytes wasted\n", report.Files, report.Wasted)
+			return nil
+		}
+	}
+}
+
+func sendUsage(dir string, depth int, conn net.Conn) error {
+	jsonReq, err := json.Marshal(UsageRequest{Dir: dir, Depth: depth, Top: 10})
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "usage",
+		Data: string(jsonReq),
+	})
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+	if ipcMessage.Type == "usage.error" {
+		fmt.Println("Usage error:", ipcMessage.Data)
+		return nil
+	}
+
+	var usage DirUsage
+	err = json.Unmarshal([]byte(ipcMessage.Data), &usage)
+	if err != nil {
+		fmt.Println("Error decoding usage:", err)
+		return nil
+	}
+	fmt.Printf("%s: %d files, %d bytes\n", usage.Path, usage.Files, usage.Bytes)
+	fmt.Println("Largest files:")
+	for _, f := range usage.Largest {
+		fmt.Printf("  %12d %s\n", f.Size, f.Path)
+	}
+	fmt.Println("Extensions:")
+	for _, e := range usage.Extensions {
+		fmt.Printf("  %12d %6d .%s\n", e.Bytes, e.Files, e.Ext)
+	}
+	fmt.Println("Directories:")
+	printUsage(usage.Children, "  ")
+	return nil
+}
+
+func printUsage(dirs []DirUsage, indent string) {
+	for _, d := range dirs {
+		fmt.Printf("%s%12d %6d %s\n", indent, d.Bytes, d.Files, d.Path)
+		printUsage(d.Children, indent+"  ")
+	}
+}
+
+func sendRoots(conn net.Conn) error {
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "roots",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+
+	var roots []RootStatus
+	err = json.Unmarshal([]byte(ipcMessage.Data), &roots)
+	if err != nil {
+		fmt.Println("Error decoding roots:", err)
+		return nil
+	}
+	if len(roots) == 0 {
+		fmt.Println("No roots are configured")
+	}
+	for _, r := range roots {
+		fmt.Println(r.Path)
+		if len(r.Exclude) > 0 {
+			fmt.Println("  exclude:", strings.Join(r.Exclude, ", "))
+		}
+		if r.MaxDepth > 0 {
+			fmt.Println("  max depth:", r.MaxDepth)
+		}
+		fmt.Printf("  symlinks: %s, schedule: %s\n", r.Symlinks, r.Schedule)
+		if r.Indexed.IsZero() {
+			fmt.Println("  not indexed yet")
+		} else {
+			fmt.Printf("  %d files, indexed %s\n", r.Files, r.Indexed.Format(time.RFC1123))
+		}
+	}
+	return nil
+}
+
+func sendConfigGet(conn net.Conn) error {
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "config.get",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+
+	var info ConfigInfo
+	err = json.Unmarshal([]byte(ipcMessage.Data), &info)
+	if err != nil {
+		fmt.Println("Error decoding config:", err)
+		return nil
+	}
+	fmt.Println("# Running config, read from", info.File)
+	fmt.Print(info.Config)
+	return nil
+}
+
+func sendConfigReload(conn net.Conn) error {
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "config.reload",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+
+	if ipcMessage.Type == "config.reload.error" {
+		var reason string
+		json.Unmarshal([]byte(ipcMessage.Data), &reason)
+		fmt.Println("The config was not reloaded:", reason)
+		return nil
+	}
+	var reload ConfigReload
+	err = json.Unmarshal([]byte(ipcMessage.Data), &reload)
+	if err != nil {
+		fmt.Println("Error decoding reload:", err)
+		return nil
+	}
+	if len(reload.Applied) == 0 {
+		fmt.Println("Nothing changed")
+	} else {
+		fmt.Println("Applied:", strings.Join(reload.Applied, ", "))
+	}
+	if reload.Reindex {
+		fmt.Println("Every root is being indexed again")
+	}
+	if len(reload.Restart) > 0 {
+		fmt.Println("Applied when vfmpd is restarted:", strings.Join(reload.Restart, ", "))
+	}
+	return nil
+}
+
+func sendSchedule(conn net.Conn) error {
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "schedule",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+
+	var status []ScheduleStatus
+	err = json.Unmarshal([]byte(ipcMessage.Data), &status)
+	if err != nil {
+		fmt.Println("Error decoding schedule:", err)
+		return nil
+	}
+	if len(status) == 0 {
+		fmt.Println("Nothing is scheduled")
+	}
+	for _, s := range status {
+		fmt.Printf("%s (%s)\n", s.Root, s.Schedule)
+		if s.Running {
+			fmt.Println("  running now")
+		}
+		if !s.LastRun.IsZero() {
+			fmt.Printf("  last run: %s, took %s\n", s.LastRun.Format(time.RFC1123), s.LastDuration.Round(time.Millisecond))
+		}
+		if s.LastError != "" {
+			fmt.Println("  last error:", s.LastError)
+		}
+		if !s.NextRun.IsZero() {
+			fmt.Println("  next run:", s.NextRun.Format(time.RFC1123))
+		}
+	}
+	return nil
+}
+
+func sendStats(conn net.Conn) error {
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "stats",
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+
+	var stats DaemonStats
+	err = json.Unmarshal([]byte(ipcMessage.Data), &stats)
+	if err != nil {
+		fmt.Println("Error decoding stats:", err)
+		return nil
+	}
+	fmt.Println("Uptime:", stats.Uptime)
+	fmt.Printf("Connections: %d open, %d in total\n", stats.Connections.Open, stats.Connections.Total)
+	fmt.Printf("Memory: %d bytes allocated, %d bytes from the system, %d goroutines\n", stats.Memory.Alloc, stats.Memory.Sys, stats.Memory.Goroutines)
+	for _, index := range stats.Indexes {
+		fmt.Printf("Index %s: %d bytes, written %s ago", index.Name, index.Size, index.Age)
+		if index.Loaded {
+			fmt.Printf(", loaded with %d entries", index.Entries)
+		}
+		fmt.Println()
+	}
+	jobs := make([]string, 0, len(stats.Jobs))
+	for name := range stats.Jobs {
+		jobs = append(jobs, name)
+	}
+	sort.Strings(jobs)
+	for _, name := range jobs {
+		job := stats.Jobs[name]
+		fmt.Printf("Job %s: %d done, %d running, last took %s\n", name, job.Count, job.Running, job.LastDuration.Round(time.Microsecond))
+	}
+	modes := make([]string, 0, len(stats.Searches))
+	for mode := range stats.Searches {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		latency := stats.Searches[mode]
+		fmt.Printf("Search %s: %d searches, %s on average\n", mode, latency.Count, (latency.Sum / time.Duration(latency.Count)).Round(time.Microsecond))
+	}
+	return nil
+}
+
+func sendOpen(path string, conn net.Conn) error {
+	jsonReq, err := json.Marshal(OpenRequest{Path: path})
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(IPCMessage{
+		Type: "open",
+		Data: string(jsonReq),
+	})
+
+	_, err = conn.Write(append(jsonData, '\n'))
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	message, err := reader.ReadString('\n')
+	if err != nil {
+		fmt.Println("Error reading from connection:", err)
+		return nil
+	}
+
+	var ipcMessage IPCMessage
+	err = json.Unmarshal([]byte(message), &ipcMessage)
+	if err != nil {
+		fmt.Println("Error unmarshalling IPCMessage:", err)
+		return nil
+	}
+	if ipcMessage.Type == "open.done" {
+		fmt.Println("Open recorded")
+	}
+	return nil
+}
+
+func sendSearch(path, search, mode string, conn net.Conn) error {
 	req := SearchRequest{
 		Dir:          path,
 		SearchString: search,
-		FuzzySearch:  fuzzy,
+		Mode:         mode,
 		MaxResults:   10,
 	}
 	jsonReq, err := json.Marshal(req)
@@ -247,7 +915,15 @@ func sendSearch(path, search string, fuzzy bool, conn net.Conn) error {
 		return nil
 	}
 
-	if req.FuzzySearch {
+	// Searches that cannot be run, like queries with syntax errors, get an
+	// error message instead of results.
+	var ipcMessage IPCMessage
+	if json.Unmarshal([]byte(message), &ipcMessage) == nil && ipcMessage.Type == "search.error" {
+		fmt.Println("Search error:", ipcMessage.Data)
+		return nil
+	}
+
+	if req.Mode == "fuzzy" {
 		var matches []Match
 		err = json.NewDecoder(strings.NewReader(strings.TrimSuffix(message, "\n"))).Decode(&matches)
 		if err != nil {
@@ -255,6 +931,14 @@ func sendSearch(path, search string, fuzzy bool, conn net.Conn) error {
 			return nil
 		}
 		fmt.Println("Matches:", matches)
+	} else if req.Mode == "typo" {
+		var matches []TypoMatch
+		err = json.NewDecoder(strings.NewReader(strings.TrimSuffix(message, "\n"))).Decode(&matches)
+		if err != nil {
+			fmt.Println("Error decoding matches:", err)
+			return nil
+		}
+		fmt.Println("Matches:", matches)
 	} else {
 		var files []string
 		err = json.NewDecoder(strings.NewReader(strings.TrimSuffix(message, "\n"))).Decode(&files)
@@ -7,23 +7,12 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
-	"path/filepath"
 	"strings"
 
+	"github.com/vyPal/VFMP/vfmpconfig"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
-	"gopkg.in/yaml.v2"
 )
 
-type ConfigDatabase struct {
-	Data struct {
-		Dir string `yaml:"dir" default:"/var/lib/vfmp"`
-	} `yaml:"data"`
-	Server struct {
-		Port int `yaml:"port" default:"32768"`
-	}
-}
-
 type IPCMessage struct {
 	Type string `json:"type"`
 	Data string `json:"data"`
@@ -48,47 +37,44 @@ type SearchRequest struct {
 }
 
 type Match struct {
-	Path    string
-	Indexes []int
-	Score   int
+	Path      string
+	Indexes   []int
+	Score     float64
+	Breakdown ScoreBreakdown
+}
+
+type ScoreBreakdown struct {
+	Fuzzy    float64
+	BaseName float64
+	Depth    float64
+	Recency  float64
+	History  float64
 }
 
 // App struct
 type App struct {
 	ctx  context.Context
 	conn net.Conn
+	// Client config given with --config, client.yaml if empty
+	configFile string
 }
 
 // NewApp creates a new App application struct
-func NewApp() *App {
-	return &App{}
+func NewApp(configFile string) *App {
+	return &App{configFile: configFile}
 }
 
 // startup is called when the app starts. The context is saved
 // so we can call the runtime methods
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
-	// Set the path to the config file
-	configFile := filepath.Join("/root", ".config", "vfmp", "config.yaml")
-
-	// Read the config file
-	var config ConfigDatabase
-	data, err := os.ReadFile(configFile)
+	config, err := vfmpconfig.LoadClient(a.configFile)
 	if err != nil {
 		log.Fatalf("Failed to read config file: %v", err)
 	}
 
-	// Parse the config file
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		log.Fatalf("Failed to parse config file: %v", err)
-	}
-
-	// Set the server address and port
-	serverAddr := fmt.Sprintf("localhost:%d", config.Server.Port)
-
 	// Connect to the server
-	conn, err := net.Dial("tcp", serverAddr)
+	conn, err := net.Dial("tcp", config.Server.Address)
 	if err != nil {
 		fmt.Printf("Failed to connect to server: %v\n", err)
 		return
@@ -3,8 +3,8 @@ module github.com/vyPal/VFMP/gui
 go 1.18
 
 require (
+	github.com/vyPal/VFMP/vfmpconfig v0.0.0
 	github.com/wailsapp/wails/v2 v2.6.0
-	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -33,6 +33,9 @@ require (
 	golang.org/x/net v0.10.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
 
 // replace github.com/wailsapp/wails/v2 v2.6.0 => /home/vypal/go/pkg/mod
+
+replace github.com/vyPal/VFMP/vfmpconfig => ../vfmpconfig
@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"flag"
 
 	"github.com/wailsapp/wails/v2"
 	"github.com/wailsapp/wails/v2/pkg/options"
@@ -12,8 +13,11 @@ import (
 var assets embed.FS
 
 func main() {
+	configFile := flag.String("config", "", "client config `file` to use instead of client.yaml in the user config directory")
+	flag.Parse()
+
 	// Create an instance of the app structure
-	app := NewApp()
+	app := NewApp(*configFile)
 
 	// Create application with options
 	err := wails.Run(&options.App{
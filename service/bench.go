@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// benchFormats indexes root once and then compares how long each index
+// format takes to save and load the resulting trie, and how large the
+// files are on disk. The files are written to a temporary directory.
+func benchFormats(root string, rounds int) {
+	var trie HybridTrie
+	count := make(chan int)
+
+	log.Print("Indexing ", root)
+	start := time.Now()
+	go walkFiles(Root{Path: root, Symlinks: SymlinksRecord}, count, &trie)
+	files := 0
+	for c := range count {
+		files = c
+	}
+	log.Printf("Indexed %d files in %dms", files, time.Since(start).Milliseconds())
+
+	tmpDir, err := os.MkdirTemp("", "vfmp-bench")
+	if err != nil {
+		log.Fatal("Unable to create temporary directory: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, format := range []string{FormatGob, FormatProto, FormatFlat} {
+		filename := filepath.Join(tmpDir, "trie."+indexExtension(format))
+
+		var save, load time.Duration
+		for i := 0; i < rounds; i++ {
+			start = time.Now()
+			err = trie.SaveToFile(filename, format)
+			if err != nil {
+				log.Fatalf("Unable to save %s index: %v", format, err)
+			}
+			save += time.Since(start)
+
+			var loaded HybridTrie
+			start = time.Now()
+			err = loaded.LoadFromFile(filename, format)
+			if err != nil {
+				log.Fatalf("Unable to load %s index: %v", format, err)
+			}
+			load += time.Since(start)
+		}
+
+		info, err := os.Stat(filename)
+		if err != nil {
+			log.Fatalf("Unable to stat %s index: %v", format, err)
+		}
+
+		log.Printf("%-6s save: %6dms  load: %6dms  size: %d bytes", format,
+			(save / time.Duration(rounds)).Milliseconds(),
+			(load / time.Duration(rounds)).Milliseconds(),
+			info.Size())
+	}
+}
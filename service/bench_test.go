@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// benchTrie returns a trie of about 100k files spread over nested
+// directories, like a source tree.
+func benchTrie() *HybridTrie {
+	var trie HybridTrie
+	for a := 0; a < 20; a++ {
+		for b := 0; b < 50; b++ {
+			for c := 0; c < 100; c++ {
+				trie.AddPath(fmt.Sprintf("/home/user/project%d/pkg%d/file%d.go", a, b, c))
+			}
+		}
+	}
+	return &trie
+}
+
+func benchmarkSaveLoad(b *testing.B, format string) {
+	trie := benchTrie()
+	filename := filepath.Join(b.TempDir(), "trie."+indexExtension(format))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := trie.SaveToFile(filename, format); err != nil {
+			b.Fatal(err)
+		}
+		var loaded HybridTrie
+		if err := loaded.LoadFromFile(filename, format); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSaveLoadGob(b *testing.B) {
+	benchmarkSaveLoad(b, FormatGob)
+}
+
+func BenchmarkSaveLoadProto(b *testing.B) {
+	benchmarkSaveLoad(b, FormatProto)
+}
@@ -1,24 +1,128 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	reflect "reflect"
 	"strconv"
+	"strings"
 
 	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/vyPal/VFMP/vfmpconfig"
 	"gopkg.in/yaml.v2"
 )
 
 type ConfigDatabase struct {
 	Data struct {
-		Dir     string `yaml:"dir" default:"/var/lib/vfmp"`
-		RootDir string `yaml:"root_dir" default:"/home/vypal/Dokumenty/GitHub/VFMP"`
+		Dir string `yaml:"dir" default:"/var/lib/vfmp" env:"VFMP_DATA_DIR"`
 	} `yaml:"data"`
+	// Directories to keep indexed
+	Roots  []Root `yaml:"roots"`
 	Server struct {
-		Port int `yaml:"port" default:"32768"`
+		Port int `yaml:"port" default:"32768" env:"VFMP_PORT"`
 	}
+	Index struct {
+		Format string `yaml:"format" default:"gob" env:"VFMP_INDEX_FORMAT"`
+		// Memory used while building a flat index, in megabytes
+		MemoryBudget int `yaml:"memory_budget_mb" default:"256" env:"VFMP_INDEX_MEMORY_BUDGET_MB"`
+	} `yaml:"index"`
+	Search struct {
+		// Changing these requires indexing again
+		IgnoreCase    bool   `yaml:"ignore_case" default:"false" env:"VFMP_SEARCH_IGNORE_CASE"`
+		Normalization string `yaml:"normalization" default:"nfc" env:"VFMP_SEARCH_NORMALIZATION"`
+	} `yaml:"search"`
+	// Weights of the parts of a fuzzy search score
+	Ranking struct {
+		Fuzzy    float64 `yaml:"fuzzy" default:"1" env:"VFMP_RANKING_FUZZY"`
+		BaseName float64 `yaml:"base_name" default:"1" env:"VFMP_RANKING_BASE_NAME"`
+		Depth    float64 `yaml:"depth" default:"5" env:"VFMP_RANKING_DEPTH"`
+		Recency  float64 `yaml:"recency" default:"50" env:"VFMP_RANKING_RECENCY"`
+		// Days after which the recency bonus is halved
+		HalfLife int     `yaml:"half_life_days" default:"7" env:"VFMP_RANKING_HALF_LIFE_DAYS"`
+		History  float64 `yaml:"history" default:"50" env:"VFMP_RANKING_HISTORY"`
+	} `yaml:"ranking"`
+	Content struct {
+		// Index the words in text files for content search
+		Enabled bool `yaml:"enabled" default:"false" env:"VFMP_CONTENT_ENABLED"`
+		// Larger files are skipped, in kilobytes
+		MaxFileSize int `yaml:"max_file_size_kb" default:"1024" env:"VFMP_CONTENT_MAX_FILE_SIZE_KB"`
+		// Comma separated prefixes of the MIME types to index
+		MimeTypes string `yaml:"mime_types" default:"text/" env:"VFMP_CONTENT_MIME_TYPES"`
+	} `yaml:"content"`
+	// Indexing the roots again on their schedules
+	Schedule struct {
+		// Largest random delay added to every run, in seconds
+		Jitter int `yaml:"jitter_s" default:"300" env:"VFMP_SCHEDULE_JITTER_S"`
+	} `yaml:"schedule"`
+	// The log of the daemon, vfmpd.log in the data directory unless it runs
+	// in the foreground
+	Log struct {
+		// debug, info, warn or error
+		Level string `yaml:"level" default:"info" env:"VFMP_LOG_LEVEL"`
+		// text or json
+		Format string `yaml:"format" default:"text" env:"VFMP_LOG_FORMAT"`
+		// Rotate the log once it is larger, in megabytes, 0 for no limit
+		MaxSize int `yaml:"max_size_mb" default:"10" env:"VFMP_LOG_MAX_SIZE_MB"`
+		// Rotate the log once it is older, in days, 0 for no limit
+		MaxAge int `yaml:"max_age_days" default:"7" env:"VFMP_LOG_MAX_AGE_DAYS"`
+		// Rotated logs to keep
+		MaxFiles int `yaml:"max_files" default:"5" env:"VFMP_LOG_MAX_FILES"`
+	} `yaml:"log"`
+	// Prometheus metrics and a health check over HTTP
+	Metrics struct {
+		Enabled bool   `yaml:"enabled" default:"false" env:"VFMP_METRICS_ENABLED"`
+		Address string `yaml:"address" default:"localhost:9187" env:"VFMP_METRICS_ADDRESS"`
+	} `yaml:"metrics"`
+}
+
+// configPath is the config file that was loaded, which is read again when
+// the daemon reloads its config.
+var configPath string
+
+// findConfigFile returns the config file of vfmpd: the one given with
+// -config or $VFMP_CONFIG, else /etc/vfmp/config.yaml, else config.yaml in
+// the vfmp directory of the user config directory. When neither exists, it
+// is created in the first of the two directories that can be made.
+func findConfigFile() (string, error) {
+	if file := os.Getenv("VFMP_CONFIG"); file != "" {
+		return filepath.Abs(file)
+	}
+
+	candidates := vfmpconfig.DaemonFiles()
+	for _, file := range candidates {
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+	}
+
+	var errs []error
+	for _, file := range candidates {
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err == nil {
+			return file, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// indexFile returns the path of the index file for the configured format.
+func indexFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "trie."+indexExtension(cfg.Index.Format))
+}
+
+// nameIndexFile returns the path of the secondary name index.
+func nameIndexFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "names.gob")
+}
+
+// contentIndexFile returns the path of the content index.
+func contentIndexFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "content.gob")
 }
 
 func DefaultConfig() ConfigDatabase {
@@ -71,9 +175,8 @@ func setDefaults(s interface{}) {
 			}
 		} else if field.Kind() == reflect.Struct {
 			setDefaults(field.Addr().Interface())
-		} else {
-			log.Fatalf("No default value for field %s", t.Field(i).Name)
 		}
+		// Other fields are left at their zero value.
 	}
 }
 
@@ -90,60 +193,54 @@ func updateConfigFile(configFile string, cfg *ConfigDatabase) error {
 		return fmt.Errorf("unable to unmarshal config file: %w", err)
 	}
 
+	// The keys that are in the file, so that values set to zero or false
+	// are told apart from missing ones
+	var present map[interface{}]interface{}
+	err = yaml.Unmarshal(data, &present)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal config file: %w", err)
+	}
+
 	// Check if each field exists in the config file
 	defaultCfg := DefaultConfig()
 	updated := false
 
 	// Write a dynamic function to go through the struct recursively
-	var checkField func(interface{}, interface{}, string)
-	checkField = func(cfg interface{}, defaultCfg interface{}, path string) {
-		v := reflect.ValueOf(cfg).Elem()
+	var checkField func(reflect.Value, reflect.Value, map[interface{}]interface{}, string)
+	checkField = func(v reflect.Value, defaults reflect.Value, present map[interface{}]interface{}, path string) {
 		t := v.Type()
 
 		for i := 0; i < v.NumField(); i++ {
 			field := v.Field(i)
-			tag := t.Field(i).Tag.Get("default")
-
-			if tag != "" {
-				switch field.Kind() {
-				case reflect.Struct:
-					checkField(field.Addr().Interface(), reflect.ValueOf(defaultCfg).Elem().Field(i).Addr().Interface(), path+t.Field(i).Name+".")
-				case reflect.String:
-					if field.String() == "" {
-						log.Printf("%s%s is not set, using default value: %s", path, t.Field(i).Name, tag)
-						field.SetString(tag)
-						updated = true
-					}
-				case reflect.Int:
-					if field.Int() == 0 {
-						intValue, err := strconv.ParseInt(tag, 0, field.Type().Bits())
-						if err != nil {
-							log.Fatalf("Unable to parse default value for field %s: %v", t.Field(i).Name, err)
-						}
-						log.Printf("%s%s is not set, using default value: %d", path, t.Field(i).Name, intValue)
-						field.SetInt(intValue)
-						updated = true
-					}
-				case reflect.Bool:
-					if !field.Bool() {
-						boolValue, err := strconv.ParseBool(tag)
-						if err != nil {
-							log.Fatalf("Unable to parse default value for field %s: %v", t.Field(i).Name, err)
-						}
-						log.Printf("%s%s is not set, using default value: %t", path, t.Field(i).Name, boolValue)
-						field.SetBool(boolValue)
-						updated = true
+			key := yamlKey(t.Field(i))
+			value := present[key]
+
+			switch {
+			case field.Kind() == reflect.Struct:
+				section, _ := value.(map[interface{}]interface{})
+				checkField(field, defaults.Field(i), section, path+key+".")
+			case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+				// Every element is checked against an element with only
+				// the default values.
+				items, _ := value.([]interface{})
+				defaultElem := reflect.New(field.Type().Elem())
+				setDefaults(defaultElem.Interface())
+				for j := 0; j < field.Len(); j++ {
+					var item map[interface{}]interface{}
+					if j < len(items) {
+						item, _ = items[j].(map[interface{}]interface{})
 					}
-				default:
-					log.Fatalf("Unsupported field type for field %s: %v", t.Field(i).Name, field.Kind())
+					checkField(field.Index(j), defaultElem.Elem(), item, fmt.Sprintf("%s%s[%d].", path, key, j))
 				}
-			} else if field.Kind() == reflect.Struct {
-				checkField(field.Addr().Interface(), reflect.ValueOf(defaultCfg).Elem().Field(i).Addr().Interface(), path+t.Field(i).Name+".")
+			case value == nil && t.Field(i).Tag.Get("default") != "":
+				log.Printf("%s%s is not set, using default value: %v", path, key, defaults.Field(i).Interface())
+				field.Set(defaults.Field(i))
+				updated = true
 			}
 		}
 	}
 
-	checkField(cfg, &defaultCfg, "")
+	checkField(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(defaultCfg), present, "")
 
 	// Save updated config file
 	if updated {
@@ -152,24 +249,148 @@ func updateConfigFile(configFile string, cfg *ConfigDatabase) error {
 			return fmt.Errorf("unable to marshal config: %w", err)
 		}
 
+		// A read-only config file still works with the defaults.
 		err = os.WriteFile(configFile, data, 0644)
 		if err != nil {
-			return fmt.Errorf("unable to write config file: %w", err)
+			log.Print("Unable to add the default values to the config file: ", err)
 		}
 	}
 
 	return nil
 }
 
+// yamlKey returns the key of field in the config file.
+func yamlKey(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); name != "" {
+		return name
+	}
+	return strings.ToLower(field.Name)
+}
+
+// readConfig reads configFile into cfg, adding the missing values to the
+// file, applies the environment variables, which the flags of vfmpd set,
+// and checks the values.
+func readConfig(configFile string, cfg *ConfigDatabase) error {
+	err := updateConfigFile(configFile, cfg)
+	if err != nil {
+		return fmt.Errorf("unable to update config file: %w", err)
+	}
+
+	err = cleanenv.ReadEnv(cfg)
+	if err != nil {
+		return fmt.Errorf("unable to read config from the environment: %w", err)
+	}
+
+	for i := range cfg.Roots {
+		if cfg.Roots[i].Path != "" {
+			cfg.Roots[i].Path = filepath.Clean(cfg.Roots[i].Path)
+		}
+	}
+	err = validConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+	return nil
+}
+
+// validConfig checks the values of cfg and reports every problem found.
+func validConfig(cfg *ConfigDatabase) error {
+	var errs []error
+	if cfg.Server.Port < 0 || cfg.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port: %d is not a port number", cfg.Server.Port))
+	}
+	if !filepath.IsAbs(cfg.Data.Dir) {
+		errs = append(errs, fmt.Errorf("data.dir: %q is not absolute", cfg.Data.Dir))
+	}
+	switch cfg.Index.Format {
+	case FormatGob, FormatProto, FormatFlat:
+	default:
+		errs = append(errs, fmt.Errorf("index.format: %q is not gob, proto or flat", cfg.Index.Format))
+	}
+	if cfg.Index.MemoryBudget <= 0 {
+		errs = append(errs, errors.New("index.memory_budget_mb must be positive"))
+	}
+	if err := validNormalization(cfg.Search.Normalization); err != nil {
+		errs = append(errs, fmt.Errorf("search.normalization: %w", err))
+	}
+	r := cfg.Ranking
+	if r.Fuzzy < 0 || r.BaseName < 0 || r.Depth < 0 || r.Recency < 0 || r.HalfLife < 0 || r.History < 0 {
+		errs = append(errs, errors.New("ranking: weights and half_life_days must not be negative"))
+	}
+	if cfg.Content.MaxFileSize < 0 {
+		errs = append(errs, errors.New("content.max_file_size_kb must not be negative"))
+	}
+	if cfg.Schedule.Jitter < 0 {
+		errs = append(errs, errors.New("schedule.jitter_s must not be negative"))
+	}
+	if cfg.Metrics.Enabled && cfg.Metrics.Address == "" {
+		errs = append(errs, errors.New("metrics.address must be set when metrics are enabled"))
+	}
+	errs = append(errs, validRoots(cfg.Roots), validLog(cfg))
+	return errors.Join(errs...)
+}
+
+// configFlags are the flags of vfmpd that choose the config file or
+// override its values. A flag sets the environment variable of its value,
+// so that it takes precedence over the environment and the config file, in
+// the daemon process too and when the config is reloaded.
+var configFlags = []struct {
+	name  string
+	env   string
+	kind  reflect.Kind
+	usage string
+}{
+	{"config", "VFMP_CONFIG", reflect.String, "config `file` to use instead of " + vfmpconfig.SystemFile},
+	{"port", "VFMP_PORT", reflect.Int, "`port` to listen on"},
+	{"data-dir", "VFMP_DATA_DIR", reflect.String, "`directory` of the index, the log and the PID file"},
+	{"index-format", "VFMP_INDEX_FORMAT", reflect.String, "`format` of the index: gob, proto or flat"},
+	{"log-level", "VFMP_LOG_LEVEL", reflect.String, "`level` of the log: debug, info, warn or error"},
+	{"log-format", "VFMP_LOG_FORMAT", reflect.String, "`format` of the log: text or json"},
+	{"metrics", "VFMP_METRICS_ENABLED", reflect.Bool, "serve Prometheus metrics"},
+	{"metrics-address", "VFMP_METRICS_ADDRESS", reflect.String, "`address` to serve metrics on"},
+}
+
+// registerConfigFlags adds the config flags to fs.
+func registerConfigFlags(fs *flag.FlagSet) {
+	for _, f := range configFlags {
+		fs.Var(envFlag{env: f.env, kind: f.kind}, f.name, fmt.Sprintf("%s (overrides $%s)", f.usage, f.env))
+	}
+}
+
+// envFlag is a flag that sets an environment variable.
+type envFlag struct {
+	env  string
+	kind reflect.Kind
+}
+
+func (f envFlag) String() string {
+	return ""
+}
+
+func (f envFlag) Set(value string) error {
+	var err error
+	switch f.kind {
+	case reflect.Int:
+		_, err = strconv.Atoi(value)
+	case reflect.Bool:
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Setenv(f.env, value)
+}
+
+func (f envFlag) IsBoolFlag() bool {
+	return f.kind == reflect.Bool
+}
+
 func ProcessConfig(configFile string, cfg *ConfigDatabase) {
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		log.Print("Config file does not exist, creating a new one with default values")
 
-		cfg := DefaultConfig()
-
-		log.Println("Data Dir is not set, using default value:", cfg.Data.Dir)
-
-		data, err := yaml.Marshal(&cfg)
+		defaultCfg := DefaultConfig()
+		data, err := yaml.Marshal(&defaultCfg)
 		if err != nil {
 			log.Fatal("Unable to marshal config:", err)
 		}
@@ -178,26 +399,18 @@ func ProcessConfig(configFile string, cfg *ConfigDatabase) {
 		if err != nil {
 			log.Fatal("Unable to write config:", err)
 		}
-		if err != nil {
-			log.Fatal("Unable to write config:", err)
-		}
-	} else {
-		err = updateConfigFile(configFile, cfg)
-		if err != nil {
-			log.Fatal("Unable to update config file:", err)
-		}
+	}
 
-		err = cleanenv.ReadConfig(configFile, cfg)
-		if err != nil {
-			log.Fatal("Unable to read config:", err)
-		}
+	err := readConfig(configFile, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		if _, err := os.Stat(cfg.Data.Dir); os.IsNotExist(err) {
-			log.Print("vfmp data directory does not exist, creating a new one")
-			err = os.Mkdir(cfg.Data.Dir, 0755)
-			if err != nil {
-				log.Fatal("Unable to create vfmp data directory:", err)
-			}
+	if _, err := os.Stat(cfg.Data.Dir); os.IsNotExist(err) {
+		log.Print("vfmp data directory does not exist, creating a new one")
+		err = os.Mkdir(cfg.Data.Dir, 0755)
+		if err != nil {
+			log.Fatal("Unable to create vfmp data directory:", err)
 		}
 	}
 }
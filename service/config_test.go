@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// clearConfigEnv unsets every config environment variable for the duration
+// of the test, including those the flags set.
+func clearConfigEnv(t *testing.T) {
+	for _, env := range os.Environ() {
+		if key, _, _ := strings.Cut(env, "="); strings.HasPrefix(key, "VFMP_") {
+			t.Setenv(key, "")
+			os.Unsetenv(key)
+		}
+	}
+	for _, f := range configFlags {
+		t.Setenv(f.env, "")
+		os.Unsetenv(f.env)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags []string
+		check func(cfg *ConfigDatabase) bool
+	}{
+		{"defaults", "{}\n", nil, nil, func(cfg *ConfigDatabase) bool {
+			return cfg.Server.Port == 32768 && cfg.Index.Format == FormatGob && cfg.Content.MaxFileSize == 1024 && !cfg.Metrics.Enabled
+		}},
+		{"file over default", "server:\n  port: 1000\n", nil, nil, func(cfg *ConfigDatabase) bool {
+			return cfg.Server.Port == 1000
+		}},
+		{"env over file", "server:\n  port: 1000\n", map[string]string{"VFMP_PORT": "2000"}, nil, func(cfg *ConfigDatabase) bool {
+			return cfg.Server.Port == 2000
+		}},
+		{"flag over env", "server:\n  port: 1000\n", map[string]string{"VFMP_PORT": "2000"}, []string{"-port", "3000"}, func(cfg *ConfigDatabase) bool {
+			return cfg.Server.Port == 3000
+		}},
+		{"zero in file", "content:\n  max_file_size_kb: 0\nlog:\n  max_size_mb: 0\n", nil, nil, func(cfg *ConfigDatabase) bool {
+			return cfg.Content.MaxFileSize == 0 && cfg.Log.MaxSize == 0 && cfg.Log.MaxAge == 7
+		}},
+		{"false in env", "metrics:\n  enabled: true\n", map[string]string{"VFMP_METRICS_ENABLED": "false"}, nil, func(cfg *ConfigDatabase) bool {
+			return !cfg.Metrics.Enabled
+		}},
+		{"bool flag", "metrics:\n  enabled: false\n", nil, []string{"-metrics", "-index-format", "flat"}, func(cfg *ConfigDatabase) bool {
+			return cfg.Metrics.Enabled && cfg.Index.Format == FormatFlat
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			fs := flag.NewFlagSet("vfmpd", flag.ContinueOnError)
+			registerConfigFlags(fs)
+			if err := fs.Parse(test.flags); err != nil {
+				t.Fatal(err)
+			}
+
+			file := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(file, []byte(test.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var cfg ConfigDatabase
+			if err := readConfig(file, &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if !test.check(&cfg) {
+				t.Errorf("unexpected config: %+v", cfg)
+			}
+
+			// Missing keys are added to the file with their defaults, and
+			// values that were set are kept, even when they are zero.
+			var saved ConfigDatabase
+			if err := updateConfigFile(file, &saved); err != nil {
+				t.Fatal(err)
+			}
+			if saved.Index.MemoryBudget != 256 {
+				t.Errorf("memory_budget_mb = %d in the saved file, want the default", saved.Index.MemoryBudget)
+			}
+			if strings.Contains(test.file, "max_file_size_kb: 0") && saved.Content.MaxFileSize != 0 {
+				t.Errorf("max_file_size_kb = %d in the saved file, want 0", saved.Content.MaxFileSize)
+			}
+		})
+	}
+}
+
+func TestConfigFlagErrors(t *testing.T) {
+	clearConfigEnv(t)
+	for _, args := range [][]string{{"-port", "x"}, {"-metrics=maybe"}} {
+		fs := flag.NewFlagSet("vfmpd", flag.ContinueOnError)
+		fs.SetOutput(new(strings.Builder))
+		registerConfigFlags(fs)
+		if err := fs.Parse(args); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+}
+
+func TestValidConfig(t *testing.T) {
+	clearConfigEnv(t)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	data := "server:\n  port: 70000\nindex:\n  format: x\n  memory_budget_mb: 0\nlog:\n  level: loud\n"
+	if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var cfg ConfigDatabase
+	err := readConfig(file, &cfg)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	// Every problem is reported at once.
+	for _, want := range []string{"server.port", "index.format", "index.memory_budget_mb", "log.level"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %s: %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ContentIndex is an inverted index of the words in text files. Files are
+// only ever appended, so the postings stay sorted; removed files keep their
+// id until the index is compacted.
+type ContentIndex struct {
+	// Paths of the indexed files by id, empty for removed files.
+	Files []string
+	// The lines each token appears on, as file id << 32 | line number, sorted.
+	Postings map[string][]uint64
+
+	limits ContentLimits
+	ids    map[string]uint32
+}
+
+// ContentLimits decides which files are read into the content index.
+type ContentLimits struct {
+	MaxSize int64
+	// Prefixes of the accepted MIME types, like "text/".
+	MimeTypes []string
+}
+
+func contentLimitsFromConfig(cfg *ConfigDatabase) ContentLimits {
+	var types []string
+	for _, t := range strings.Split(cfg.Content.MimeTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return ContentLimits{
+		MaxSize:   int64(cfg.Content.MaxFileSize) << 10,
+		MimeTypes: types,
+	}
+}
+
+// ContentMatch is a file found by content search, with the lines that hold
+// every word of the query.
+type ContentMatch struct {
+	Path  string
+	Lines []int
+}
+
+func NewContentIndex(limits ContentLimits) *ContentIndex {
+	return &ContentIndex{
+		Postings: make(map[string][]uint64),
+		limits:   limits,
+		ids:      make(map[string]uint32),
+	}
+}
+
+// SetLimits sets the limits for files added to an index loaded from disk.
+func (idx *ContentIndex) SetLimits(limits ContentLimits) {
+	idx.limits = limits
+}
+
+// id returns the id of path, building the lookup table on first use.
+func (idx *ContentIndex) id(path string) (uint32, bool) {
+	if idx.ids == nil {
+		idx.ids = make(map[string]uint32, len(idx.Files))
+		for id, file := range idx.Files {
+			if file != "" {
+				idx.ids[file] = uint32(id)
+			}
+		}
+	}
+	id, ok := idx.ids[path]
+	return id, ok
+}
+
+// AddFile reads a file into the index if it is within the limits. A file
+// that is already indexed is read again.
+func (idx *ContentIndex) AddFile(path string, info os.FileInfo) {
+	path = strings.ReplaceAll(path, "\\", "/")
+	idx.Remove(path)
+	if !info.Mode().IsRegular() || info.Size() > idx.limits.MaxSize {
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || !idx.acceptedType(data) {
+		return
+	}
+
+	if idx.Postings == nil {
+		idx.Postings = make(map[string][]uint64)
+	}
+	id := uint32(len(idx.Files))
+	idx.Files = append(idx.Files, path)
+	idx.ids[path] = id
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	line := uint64(0)
+	for scanner.Scan() {
+		line++
+		seen := map[string]bool{}
+		for _, token := range tokenize(scanner.Text()) {
+			if !seen[token] {
+				seen[token] = true
+				idx.Postings[token] = append(idx.Postings[token], uint64(id)<<32|line)
+			}
+		}
+	}
+}
+
+func (idx *ContentIndex) acceptedType(data []byte) bool {
+	mimeType := http.DetectContentType(data)
+	for _, prefix := range idx.limits.MimeTypes {
+		if strings.HasPrefix(mimeType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenize splits text into lower case words. Single characters and very
+// long runs, which are mostly encoded data, are left out.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	tokens := words[:0]
+	for _, word := range words {
+		if len(word) >= 2 && len(word) <= 64 {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// Remove drops a file from the index.
+func (idx *ContentIndex) Remove(path string) {
+	if id, ok := idx.id(path); ok {
+		idx.Files[id] = ""
+		delete(idx.ids, path)
+	}
+}
+
+// RemoveTree drops every file below dir from the index.
+func (idx *ContentIndex) RemoveTree(dir string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for _, file := range idx.Files {
+		if strings.HasPrefix(file, prefix) {
+			idx.Remove(file)
+		}
+	}
+}
+
+// Rename moves a file or every file below a directory to a new path.
+func (idx *ContentIndex) Rename(oldPath, newPath string) {
+	oldPath = strings.TrimSuffix(oldPath, "/")
+	newPath = strings.TrimSuffix(newPath, "/")
+	idx.id(oldPath)
+	for id, file := range idx.Files {
+		if file == oldPath || strings.HasPrefix(file, oldPath+"/") {
+			renamed := newPath + file[len(oldPath):]
+			delete(idx.ids, file)
+			idx.Files[id] = renamed
+			idx.ids[renamed] = uint32(id)
+		}
+	}
+}
+
+// Compact drops removed files and renumbers the rest.
+func (idx *ContentIndex) Compact() {
+	newIDs := make([]int64, len(idx.Files))
+	files := idx.Files[:0]
+	for id, file := range idx.Files {
+		if file == "" {
+			newIDs[id] = -1
+			continue
+		}
+		newIDs[id] = int64(len(files))
+		files = append(files, file)
+	}
+	removed := len(idx.Files) - len(files)
+	idx.Files = files
+	idx.ids = nil
+	if removed == 0 {
+		return
+	}
+
+	for token, postings := range idx.Postings {
+		kept := postings[:0]
+		for _, p := range postings {
+			if id := newIDs[p>>32]; id >= 0 {
+				kept = append(kept, uint64(id)<<32|p&0xffffffff)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx.Postings, token)
+		} else {
+			idx.Postings[token] = kept
+		}
+	}
+}
+
+// Search returns the files with lines that contain every word of query.
+func (idx *ContentIndex) Search(query string, max int) []ContentMatch {
+	results := []ContentMatch{}
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return results
+	}
+
+	var postings [][]uint64
+	for _, token := range tokens {
+		list, ok := idx.Postings[token]
+		if !ok {
+			return results
+		}
+		postings = append(postings, list)
+	}
+	sort.Slice(postings, func(i, j int) bool { return len(postings[i]) < len(postings[j]) })
+
+	lines := postings[0]
+	for _, list := range postings[1:] {
+		lines = intersectLines(lines, list)
+	}
+
+	for _, p := range lines {
+		path := idx.Files[p>>32]
+		if path == "" {
+			continue
+		}
+		if n := len(results); n > 0 && results[n-1].Path == path {
+			results[n-1].Lines = append(results[n-1].Lines, int(p&0xffffffff))
+			continue
+		}
+		if max > 0 && len(results) >= max {
+			break
+		}
+		results = append(results, ContentMatch{Path: path, Lines: []int{int(p & 0xffffffff)}})
+	}
+	return results
+}
+
+// intersectLines returns the postings present in both sorted lists.
+func intersectLines(a, b []uint64) []uint64 {
+	var out []uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func (idx *ContentIndex) SaveToFile(filename string) error {
+	tmpName := filename + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	gw := gzip.NewWriter(file)
+	err = gob.NewEncoder(gw).Encode(idx)
+	if closeErr := gw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+func (idx *ContentIndex) LoadFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	return gob.NewDecoder(gr).Decode(idx)
+}
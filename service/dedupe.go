@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// partialHashSize is how much of the start and of the end of a file goes into
+// its partial hash. Files up to twice this size are hashed completely.
+const partialHashSize = 4096
+
+// DuplicateSet is a group of files with the same content.
+type DuplicateSet struct {
+	Size  int64
+	Hash  string
+	Paths []string
+	// Bytes that would be freed by keeping only one of the files.
+	Wasted int64
+}
+
+// DedupeReport is the result of a dedupe job, with the sets that waste the
+// most space first.
+type DedupeReport struct {
+	Files  int
+	Sets   []DuplicateSet
+	Wasted int64
+}
+
+// DedupeProgress is sent while a dedupe job runs. Stage is "size",
+// "partial" or "full".
+type DedupeProgress struct {
+	Stage string
+	Done  int
+	Total int
+}
+
+// dedupeFile is an indexed file considered by a dedupe job.
+type dedupeFile struct {
+	path    string
+	size    int64
+	modTime int64
+}
+
+// hashEntry caches the hashes of a file. It is valid as long as the file's
+// size and modification time have not changed. Full is empty until the full
+// hash was needed.
+type hashEntry struct {
+	Size    int64
+	ModTime int64
+	Partial string
+	Full    string
+}
+
+// hashCache keeps file hashes between dedupe jobs. It is kept apart from the
+// index, which every index run writes anew, so that hashes survive as long
+// as their files do not change. Index runs add the files they find to it, so
+// that the entries of files that are gone can be pruned.
+type hashCache struct {
+	Entries map[string]hashEntry
+
+	// The cached files found again by an index run.
+	found map[string]bool
+}
+
+// hashCacheFile returns the path of the hash cache.
+func hashCacheFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "hashes.gob")
+}
+
+func loadHashCache(filename string) *hashCache {
+	cache := &hashCache{Entries: make(map[string]hashEntry)}
+	file, err := os.Open(filename)
+	if err != nil {
+		return cache
+	}
+	defer file.Close()
+	if gob.NewDecoder(file).Decode(cache) != nil || cache.Entries == nil {
+		cache.Entries = make(map[string]hashEntry)
+	}
+	return cache
+}
+
+// AddFile records that an index run found a cached file.
+func (c *hashCache) AddFile(path string, info os.FileInfo) {
+	if _, ok := c.Entries[path]; !ok {
+		return
+	}
+	if c.found == nil {
+		c.found = make(map[string]bool)
+	}
+	c.found[path] = true
+}
+
+// prune drops the entries of files below dirs, or anywhere if dirs is empty,
+// that are not indexed.
+func (c *hashCache) prune(dirs []string, indexed map[string]bool) {
+	for path := range c.Entries {
+		if indexed[path] {
+			continue
+		}
+		for _, dir := range dirs {
+			if strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+				delete(c.Entries, path)
+				break
+			}
+		}
+		if len(dirs) == 0 {
+			delete(c.Entries, path)
+		}
+	}
+}
+
+// pruneHashCache drops the cached hashes of the files below dirs, or of every
+// file if dirs is empty, that the index run cache was added to did not find,
+// and saves the cache.
+func pruneHashCache(cache *hashCache, dirs []string, cfg *ConfigDatabase) {
+	// Nothing was hashed yet.
+	if len(cache.Entries) == 0 {
+		return
+	}
+	cache.prune(dirs, cache.found)
+	if err := cache.SaveToFile(hashCacheFile(cfg)); err != nil {
+		slog.Error("Error saving hash cache", "err", err)
+	}
+}
+
+func (c *hashCache) SaveToFile(filename string) error {
+	tmpName := filename + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	err = gob.NewEncoder(file).Encode(c)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// entry returns the cached hashes of the file at path with its current size
+// and modification time, or a new entry if the file changed.
+func (c *hashCache) entry(path string, info os.FileInfo) hashEntry {
+	size, modTime := info.Size(), info.ModTime().Unix()
+	e, ok := c.Entries[path]
+	if !ok || e.Size != size || e.ModTime != modTime {
+		return hashEntry{Size: size, ModTime: modTime}
+	}
+	return e
+}
+
+// stat returns the current metadata of f, unless the file changed since it
+// was indexed. Changed files are left for the next index run.
+func (f dedupeFile) stat() (os.FileInfo, bool) {
+	info, err := os.Stat(f.path)
+	if err != nil || info.Size() != f.size || info.ModTime().Unix() != f.modTime {
+		return nil, false
+	}
+	return info, true
+}
+
+// hashFile hashes the whole file, or only its first and last
+// partialHashSize bytes when partial is set.
+func hashFile(path string, size int64, partial bool) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if partial && size > 2*partialHashSize {
+		if _, err := io.CopyN(h, file, partialHashSize); err != nil {
+			return "", err
+		}
+		if _, err := file.Seek(-partialHashSize, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// filesBelow collects the indexed files below dirs, or every indexed file if
+// there are no dirs. Every file is listed once even if the directories overlap
+// or it has several hard links. Symbolic links recorded as links are left out,
+// they have no content.
+func (t *HybridTrie) filesBelow(dirs []string) ([]dedupeFile, error) {
+	seen := make(map[string]bool)
+	var files []dedupeFile
+	add := func(path string, node *TrieNode) {
+		if node.Link == "" && !seen[path] {
+			seen[path] = true
+			files = append(files, dedupeFile{path: path, size: node.Size, modTime: node.ModTime})
+		}
+	}
+	if len(dirs) == 0 {
+		t.walkHelper(t.root(), "", add)
+	}
+	for _, dir := range dirs {
+		if err := t.walkBelow(dir, add); err != nil {
+			return nil, fmt.Errorf("%s is not indexed", dir)
+		}
+	}
+	return collapseHardLinks(files), nil
+}
+
+// collapseHardLinks keeps one path of every file with several hard links, the
+// first one in sorted order. Hard links always have the same size, so only
+// files that share their size with another one are looked at.
+func collapseHardLinks(files []dedupeFile) []dedupeFile {
+	sizes := make(map[int64]int)
+	for _, f := range files {
+		sizes[f.size]++
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+
+	seen := make(map[fileID]bool)
+	kept := files[:0]
+	for _, f := range files {
+		if f.size > 0 && sizes[f.size] > 1 {
+			if info, err := os.Stat(f.path); err == nil {
+				if id, links, ok := fileStat(info); ok && links > 1 {
+					if seen[id] {
+						continue
+					}
+					seen[id] = true
+				}
+			}
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// walkBelow calls fn with every file at or below dir.
+func (t *HybridTrie) walkBelow(dir string, fn func(path string, node *TrieNode)) error {
+	dir = strings.TrimSuffix(dir, "/")
+	steps, inside, ok := t.locate(splitPath(dir))
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	// When dir ends inside a compressed edge, the node is further down.
+	last := steps[len(steps)-1]
+	path := dir
+	if inside > 0 {
+		path += "/" + strings.Join(last.node.edge(last.key)[inside:], "/")
+	}
+	if last.node.IsEndOfWord {
+		fn(path, last.node)
+	}
+	t.walkHelper(last.node, path+"/", fn)
+	return nil
+}
+
+func (t *HybridTrie) walkHelper(node *TrieNode, prefix string, fn func(path string, node *TrieNode)) {
+	for key, child := range node.Children {
+		newPath := prefix + child.label(key)
+		if child.IsEndOfWord {
+			fn(newPath, child)
+		}
+		t.walkHelper(child, newPath+"/", fn)
+	}
+}
+
+// findDuplicates groups files by size, then by a hash of their start and
+// end, then by a hash of the whole file. Only files that still share a group
+// are read at each step, and hashes are taken from cache when the file has
+// not changed. Every file is checked right before it is hashed, and files
+// whose size or modification time changed since they were indexed are left
+// out of their group. Empty files are skipped.
+func findDuplicates(files []dedupeFile, cache *hashCache, progress func(DedupeProgress)) DedupeReport {
+	report := DedupeReport{Files: len(files), Sets: []DuplicateSet{}}
+
+	bySize := make(map[int64][]dedupeFile)
+	for i, f := range files {
+		if f.size > 0 {
+			bySize[f.size] = append(bySize[f.size], f)
+		}
+		progress(DedupeProgress{Stage: "size", Done: i + 1, Total: len(files)})
+	}
+
+	// refine splits every group by a hash and keeps the groups that still
+	// have more than one file.
+	refine := func(groups [][]dedupeFile, stage string, hash func(f dedupeFile) (string, bool)) ([][]dedupeFile, []string) {
+		total := 0
+		for _, group := range groups {
+			total += len(group)
+		}
+		var refined [][]dedupeFile
+		var hashes []string
+		done := 0
+		for _, group := range groups {
+			byHash := make(map[string][]dedupeFile)
+			var order []string
+			for _, f := range group {
+				done++
+				progress(DedupeProgress{Stage: stage, Done: done, Total: total})
+				h, ok := hash(f)
+				if !ok {
+					continue
+				}
+				if _, ok := byHash[h]; !ok {
+					order = append(order, h)
+				}
+				byHash[h] = append(byHash[h], f)
+			}
+			for _, h := range order {
+				if len(byHash[h]) > 1 {
+					refined = append(refined, byHash[h])
+					hashes = append(hashes, h)
+				}
+			}
+		}
+		return refined, hashes
+	}
+
+	var groups [][]dedupeFile
+	for _, group := range bySize {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+	}
+
+	groups, _ = refine(groups, "partial", func(f dedupeFile) (string, bool) {
+		info, ok := f.stat()
+		if !ok {
+			return "", false
+		}
+		e := cache.entry(f.path, info)
+		if e.Partial == "" {
+			var err error
+			e.Partial, err = hashFile(f.path, f.size, true)
+			if err != nil {
+				return "", false
+			}
+			if f.size <= 2*partialHashSize {
+				e.Full = e.Partial
+			}
+			cache.Entries[f.path] = e
+		}
+		return e.Partial, true
+	})
+
+	groups, hashes := refine(groups, "full", func(f dedupeFile) (string, bool) {
+		// The file may have changed since its partial hash.
+		info, ok := f.stat()
+		if !ok {
+			return "", false
+		}
+		e := cache.entry(f.path, info)
+		if e.Full == "" {
+			var err error
+			e.Full, err = hashFile(f.path, f.size, false)
+			if err != nil {
+				return "", false
+			}
+			cache.Entries[f.path] = e
+		}
+		return e.Full, true
+	})
+
+	for i, group := range groups {
+		set := DuplicateSet{
+			Size:   group[0].size,
+			Hash:   hashes[i],
+			Wasted: group[0].size * int64(len(group)-1),
+		}
+		for _, f := range group {
+			set.Paths = append(set.Paths, f.path)
+		}
+		sort.Strings(set.Paths)
+		report.Sets = append(report.Sets, set)
+		report.Wasted += set.Wasted
+	}
+	sort.Slice(report.Sets, func(i, j int) bool {
+		if report.Sets[i].Wasted != report.Sets[j].Wasted {
+			return report.Sets[i].Wasted > report.Sets[j].Wasted
+		}
+		return report.Sets[i].Paths[0] < report.Sets[j].Paths[0]
+	})
+	return report
+}
+
+// throttle returns a progress callback that passes on at most one update per
+// interval, plus the last update of every stage.
+func throttle(interval time.Duration, send func(DedupeProgress)) func(DedupeProgress) {
+	var last time.Time
+	return func(p DedupeProgress) {
+		if p.Done == p.Total || time.Since(last) >= interval {
+			last = time.Now()
+			send(p)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sort"
+)
+
+// runSorter sorts more strings than fit in memory. Strings are buffered until
+// budget bytes are used, then sorted and spilled to a run file in dir. Merge
+// streams every string back in sorted order.
+type runSorter struct {
+	dir    string
+	budget int
+
+	buf  []string
+	size int
+	runs []string
+}
+
+// Approximate per-string overhead of the in-memory buffer.
+const runStringOverhead = 16
+
+func newRunSorter(dir string, budget int) *runSorter {
+	return &runSorter{dir: dir, budget: budget}
+}
+
+func (s *runSorter) Add(str string) error {
+	s.buf = append(s.buf, str)
+	s.size += len(str) + runStringOverhead
+	if s.size >= s.budget {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *runSorter) spill() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	sort.Strings(s.buf)
+
+	file, err := os.CreateTemp(s.dir, "run-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	s.runs = append(s.runs, file.Name())
+
+	w := bufio.NewWriter(file)
+	var length [binary.MaxVarintLen64]byte
+	for _, str := range s.buf {
+		n := binary.PutUvarint(length[:], uint64(len(str)))
+		if _, err := w.Write(length[:n]); err != nil {
+			return err
+		}
+		if _, err := w.WriteString(str); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	s.buf = s.buf[:0]
+	s.size = 0
+	return nil
+}
+
+// Merge calls fn with every added string in sorted order. Run files are
+// removed once merged.
+func (s *runSorter) Merge(fn func(str string) error) error {
+	// Everything fit into memory, no need to touch the disk.
+	if len(s.runs) == 0 {
+		sort.Strings(s.buf)
+		for _, str := range s.buf {
+			if err := fn(str); err != nil {
+				return err
+			}
+		}
+		s.buf = nil
+		return nil
+	}
+
+	if err := s.spill(); err != nil {
+		return err
+	}
+	s.buf = nil
+
+	h := &runHeap{}
+	defer func() {
+		for _, r := range h.readers {
+			r.file.Close()
+		}
+		for _, name := range s.runs {
+			os.Remove(name)
+		}
+	}()
+
+	for _, name := range s.runs {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		r := &runReader{file: file, r: bufio.NewReader(file)}
+		h.readers = append(h.readers, r)
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.active = append(h.active, r)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		r := h.active[0]
+		if err := fn(r.current); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+type runReader struct {
+	file    *os.File
+	r       *bufio.Reader
+	current string
+}
+
+func (r *runReader) next() (bool, error) {
+	length, err := binary.ReadUvarint(r.r)
+	if errors.Is(err, io.EOF) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return false, err
+	}
+	r.current = string(buf)
+	return true, nil
+}
+
+// runHeap orders the active run readers by their current string.
+type runHeap struct {
+	readers []*runReader
+	active  []*runReader
+}
+
+func (h *runHeap) Len() int           { return len(h.active) }
+func (h *runHeap) Less(i, j int) bool { return h.active[i].current < h.active[j].current }
+func (h *runHeap) Swap(i, j int)      { h.active[i], h.active[j] = h.active[j], h.active[i] }
+func (h *runHeap) Push(x interface{}) { h.active = append(h.active, x.(*runReader)) }
+func (h *runHeap) Pop() interface{} {
+	old := h.active
+	r := old[len(old)-1]
+	h.active = old[:len(old)-1]
+	return r
+}
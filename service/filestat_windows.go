@@ -0,0 +1,10 @@
+package main
+
+import "os"
+
+// fileStat returns the identity of a file and its number of hard links. The
+// FileInfo of a directory listing on Windows has neither, so links are not
+// detected there.
+func fileStat(info os.FileInfo) (fileID, uint64, bool) {
+	return fileID{}, 0, false
+}
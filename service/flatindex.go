@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The flat index is a read-only, uncompressed layout of a HybridTrie that can
+// be memory-mapped and searched in place. All integers are little endian.
+//
+//	header   flatHeaderSize bytes, see the flatHeader* offsets below
+//	strings  (stringCount+1) uint32 offsets into the blob, followed by the blob;
+//	         the strings are unique and sorted, so a string's id is its rank
+//	nodes    nodeCount records of flatNodeSize bytes; the children of every
+//	         node are stored contiguously, sorted by label. End-of-word nodes
+//	         hold the modification time and size of the file, and the string
+//	         id of the link target, which is the empty string for other files.
+//	names    nameCount pairs of uint32 key string id and node id, one for every
+//	         end-of-word node, sorted by key. The key is the name normalized with
+//	         the NameOptions stored in the header.
+//	dirs     dirCount records of flatDirSize bytes, one for every node with
+//	         children, holding the dirSummary of the files below it: the
+//	         smallest and largest size and modification time, then the bit
+//	         sets of extensions and name key bytes. Nodes refer to their
+//	         record by its index, or flatNoDir.
+const (
+	flatMagic      = "VFMPFLT1"
+	flatVersion    = 6
+	flatHeaderSize = 72
+	flatNodeSize   = 44
+	flatNameSize   = 8
+	flatDirSize    = 48
+
+	flatHeaderVersion     = 8
+	flatHeaderStringCount = 12
+	flatHeaderNodeCount   = 16
+	flatHeaderNameCount   = 20
+	flatHeaderStringsOff  = 24
+	flatHeaderNodesOff    = 32
+	flatHeaderNamesOff    = 40
+	flatHeaderRoot        = 48
+	flatHeaderFlags       = 52
+	flatHeaderNormalize   = 56
+	flatHeaderDirCount    = 60
+	flatHeaderDirsOff     = 64
+
+	flatNodeLabel      = 0
+	flatNodeParent     = 4
+	flatNodeFirstChild = 8
+	flatNodeChildCount = 12
+	flatNodeFlags      = 16
+	flatNodeModTime    = 20
+	flatNodeFileSize   = 28
+	flatNodeLink       = 36
+	flatNodeDir        = 40
+
+	flatFlagEndOfWord = 1
+
+	flatHeaderFlagIgnoreCase = 1
+
+	flatNoDir = math.MaxUint32
+)
+
+// flatNormalizations lists the normalization forms by their code in the header.
+var flatNormalizations = []string{NormalizeNone, NormalizeNFC, NormalizeNFD, NormalizeNFKC, NormalizeNFKD}
+
+// flatHeader describes the sections of a flat index.
+type flatHeader struct {
+	stringCount uint32
+	nodeCount   uint32
+	nameCount   uint32
+	dirCount    uint32
+	root        uint32
+	stringsOff  uint64
+	nodesOff    uint64
+	namesOff    uint64
+	dirsOff     uint64
+	opts        NameOptions
+}
+
+func (h *flatHeader) encode() []byte {
+	header := make([]byte, flatHeaderSize)
+	copy(header, flatMagic)
+	binary.LittleEndian.PutUint32(header[flatHeaderVersion:], flatVersion)
+	binary.LittleEndian.PutUint32(header[flatHeaderStringCount:], h.stringCount)
+	binary.LittleEndian.PutUint32(header[flatHeaderNodeCount:], h.nodeCount)
+	binary.LittleEndian.PutUint32(header[flatHeaderNameCount:], h.nameCount)
+	binary.LittleEndian.PutUint64(header[flatHeaderStringsOff:], h.stringsOff)
+	binary.LittleEndian.PutUint64(header[flatHeaderNodesOff:], h.nodesOff)
+	binary.LittleEndian.PutUint64(header[flatHeaderNamesOff:], h.namesOff)
+	binary.LittleEndian.PutUint32(header[flatHeaderRoot:], h.root)
+	binary.LittleEndian.PutUint32(header[flatHeaderDirCount:], h.dirCount)
+	binary.LittleEndian.PutUint64(header[flatHeaderDirsOff:], h.dirsOff)
+
+	var flags uint32
+	if h.opts.IgnoreCase {
+		flags |= flatHeaderFlagIgnoreCase
+	}
+	binary.LittleEndian.PutUint32(header[flatHeaderFlags:], flags)
+	for code, form := range flatNormalizations {
+		if form == h.opts.Normalization {
+			binary.LittleEndian.PutUint32(header[flatHeaderNormalize:], uint32(code))
+		}
+	}
+	return header
+}
+
+func decodeFlatHeader(data []byte) (*flatHeader, error) {
+	if len(data) < flatHeaderSize || string(data[:len(flatMagic)]) != flatMagic {
+		return nil, errInvalidFlatIndex
+	}
+	if v := binary.LittleEndian.Uint32(data[flatHeaderVersion:]); v != flatVersion {
+		return nil, fmt.Errorf("unsupported flat index version %d", v)
+	}
+	normalize := binary.LittleEndian.Uint32(data[flatHeaderNormalize:])
+	if normalize >= uint32(len(flatNormalizations)) {
+		return nil, errInvalidFlatIndex
+	}
+
+	return &flatHeader{
+		stringCount: binary.LittleEndian.Uint32(data[flatHeaderStringCount:]),
+		nodeCount:   binary.LittleEndian.Uint32(data[flatHeaderNodeCount:]),
+		nameCount:   binary.LittleEndian.Uint32(data[flatHeaderNameCount:]),
+		dirCount:    binary.LittleEndian.Uint32(data[flatHeaderDirCount:]),
+		root:        binary.LittleEndian.Uint32(data[flatHeaderRoot:]),
+		stringsOff:  binary.LittleEndian.Uint64(data[flatHeaderStringsOff:]),
+		nodesOff:    binary.LittleEndian.Uint64(data[flatHeaderNodesOff:]),
+		namesOff:    binary.LittleEndian.Uint64(data[flatHeaderNamesOff:]),
+		dirsOff:     binary.LittleEndian.Uint64(data[flatHeaderDirsOff:]),
+		opts: NameOptions{
+			IgnoreCase:    binary.LittleEndian.Uint32(data[flatHeaderFlags:])&flatHeaderFlagIgnoreCase != 0,
+			Normalization: flatNormalizations[normalize],
+		},
+	}, nil
+}
+
+// flatName is an entry of the names section.
+type flatName struct {
+	key  uint32
+	node uint32
+}
+
+var errInvalidFlatIndex = errors.New("invalid flat index")
+
+// writeFlatIndex writes t to w in the flat index layout.
+func writeFlatIndex(t *HybridTrie, w *bufio.Writer) error {
+	// Collect and sort the unique labels. Compressed edges are expanded, the
+	// flat index always has one node per path segment.
+	labelSet := map[string]struct{}{"": {}}
+	var collect func(node *TrieNode)
+	collect = func(node *TrieNode) {
+		for key, child := range node.Children {
+			for _, segment := range child.edge(key) {
+				labelSet[segment] = struct{}{}
+			}
+			if child.IsEndOfWord {
+				labelSet[child.nameKey(key)] = struct{}{}
+				labelSet[child.Link] = struct{}{}
+			}
+			collect(child)
+		}
+	}
+	collect(t.root())
+
+	// Summarize the files below every node for queries.
+	below := make(map[*TrieNode]dirSummary)
+	var summarize func(node *TrieNode) dirSummary
+	summarize = func(node *TrieNode) dirSummary {
+		sum := newDirSummary()
+		for key, child := range node.Children {
+			childSum := summarize(child)
+			sum.merge(&childSum)
+			if child.IsEndOfWord {
+				sum.add(child.lastSegment(key), child.nameKey(key), child.Size, child.ModTime)
+			}
+		}
+		below[node] = sum
+		return sum
+	}
+	summarize(t.root())
+
+	labels := make([]string, 0, len(labelSet))
+	for label := range labelSet {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	labelIDs := make(map[string]uint32, len(labels))
+	for i, label := range labels {
+		labelIDs[label] = uint32(i)
+	}
+
+	// Lay the nodes out breadth first so that siblings are contiguous. A
+	// node with pending segments stands for the middle of a compressed edge,
+	// its only child is the next segment on the way to node.
+	type flatNode struct {
+		node    *TrieNode
+		pending []string
+		label   uint32
+		parent  uint32
+		name    string
+	}
+	nodes := []flatNode{{node: t.root()}}
+	records := make([]byte, 0, flatNodeSize)
+	var names []flatName
+	var dirs []byte
+	for i := 0; i < len(nodes); i++ {
+		n := nodes[i]
+
+		firstChild := uint32(len(nodes))
+		if len(n.pending) > 0 {
+			nodes = append(nodes, flatNode{node: n.node, pending: n.pending[1:], label: labelIDs[n.pending[0]], parent: uint32(i), name: n.name})
+		} else {
+			keys := make([]string, 0, len(n.node.Children))
+			for key := range n.node.Children {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				child := n.node.Children[key]
+				edge := child.edge(key)
+				nodes = append(nodes, flatNode{node: child, pending: edge[1:], label: labelIDs[edge[0]], parent: uint32(i), name: child.nameKey(key)})
+			}
+		}
+		childCount := uint32(len(nodes)) - firstChild
+
+		var flags, link uint32
+		var modTime, size int64
+		if len(n.pending) == 0 && n.node.IsEndOfWord {
+			flags |= flatFlagEndOfWord
+			modTime = n.node.ModTime
+			size = n.node.Size
+			link = labelIDs[n.node.Link]
+			names = append(names, flatName{key: labelIDs[n.name], node: uint32(i)})
+		}
+
+		dir := uint32(flatNoDir)
+		if childCount > 0 {
+			// Below the middle of a compressed edge is the node the edge
+			// leads to, as well as everything below it.
+			sum := below[n.node]
+			if len(n.pending) > 0 && n.node.IsEndOfWord {
+				sum.add(n.pending[len(n.pending)-1], n.name, n.node.Size, n.node.ModTime)
+			}
+			dir = uint32(len(dirs) / flatDirSize)
+			dirs = appendDirSummary(dirs, &sum)
+		}
+
+		records = binary.LittleEndian.AppendUint32(records, n.label)
+		records = binary.LittleEndian.AppendUint32(records, n.parent)
+		records = binary.LittleEndian.AppendUint32(records, firstChild)
+		records = binary.LittleEndian.AppendUint32(records, childCount)
+		records = binary.LittleEndian.AppendUint32(records, flags)
+		records = binary.LittleEndian.AppendUint64(records, uint64(modTime))
+		records = binary.LittleEndian.AppendUint64(records, uint64(size))
+		records = binary.LittleEndian.AppendUint32(records, link)
+		records = binary.LittleEndian.AppendUint32(records, dir)
+	}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i].key < names[j].key
+	})
+
+	// Build the string table.
+	var blobSize uint32
+	table := make([]byte, 0, 4*(len(labels)+1))
+	for _, label := range labels {
+		table = binary.LittleEndian.AppendUint32(table, blobSize)
+		blobSize += uint32(len(label))
+	}
+	table = binary.LittleEndian.AppendUint32(table, blobSize)
+
+	header := flatHeader{
+		stringCount: uint32(len(labels)),
+		nodeCount:   uint32(len(nodes)),
+		nameCount:   uint32(len(names)),
+		dirCount:    uint32(len(dirs) / flatDirSize),
+		opts:        t.nameOptions(),
+	}
+	header.stringsOff = flatHeaderSize
+	header.nodesOff = header.stringsOff + uint64(len(table)) + uint64(blobSize)
+	header.namesOff = header.nodesOff + uint64(len(records))
+	header.dirsOff = header.namesOff + flatNameSize*uint64(len(names))
+
+	if _, err := w.Write(header.encode()); err != nil {
+		return err
+	}
+	if _, err := w.Write(table); err != nil {
+		return err
+	}
+	for _, label := range labels {
+		if _, err := w.WriteString(label); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(records); err != nil {
+		return err
+	}
+	var buf [flatNameSize]byte
+	for _, name := range names {
+		binary.LittleEndian.PutUint32(buf[:], name.key)
+		binary.LittleEndian.PutUint32(buf[4:], name.node)
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	if _, err := w.Write(dirs); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// FlatIndex is a memory-mapped flat index. It answers the same queries as
+// HybridTrie without decoding the file into Go maps.
+type FlatIndex struct {
+	data []byte
+
+	stringCount uint32
+	nodeCount   uint32
+	nameCount   uint32
+	dirCount    uint32
+	root        uint32
+	opts        NameOptions
+
+	offsets []byte
+	blob    []byte
+	nodes   []byte
+	names   []byte
+	dirs    []byte
+}
+
+// OpenFlatIndex maps filename into memory. The returned index must be closed
+// once it is no longer used.
+func OpenFlatIndex(filename string) (*FlatIndex, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < flatHeaderSize {
+		return nil, errInvalidFlatIndex
+	}
+
+	data, err := mapFile(file, uint64(info.Size()), false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to map index: %w", err)
+	}
+
+	f, err := newFlatIndex(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+	return f, nil
+}
+
+func newFlatIndex(data []byte) (*FlatIndex, error) {
+	h, err := decodeFlatHeader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FlatIndex{
+		data:        data,
+		stringCount: h.stringCount,
+		nodeCount:   h.nodeCount,
+		nameCount:   h.nameCount,
+		dirCount:    h.dirCount,
+		root:        h.root,
+		opts:        h.opts,
+	}
+
+	offsetsEnd := h.stringsOff + 4*(uint64(f.stringCount)+1)
+	namesEnd := h.namesOff + flatNameSize*uint64(f.nameCount)
+	dirsEnd := h.dirsOff + flatDirSize*uint64(f.dirCount)
+	if offsetsEnd > h.nodesOff || h.nodesOff+flatNodeSize*uint64(f.nodeCount) != h.namesOff || namesEnd != h.dirsOff || dirsEnd > uint64(len(data)) || f.root >= f.nodeCount {
+		return nil, errInvalidFlatIndex
+	}
+
+	f.offsets = data[h.stringsOff:offsetsEnd]
+	f.blob = data[offsetsEnd:h.nodesOff]
+	f.nodes = data[h.nodesOff:h.namesOff]
+	f.names = data[h.namesOff:namesEnd]
+	f.dirs = data[h.dirsOff:dirsEnd]
+	if uint64(binary.LittleEndian.Uint32(f.offsets[4*uint64(f.stringCount):])) != uint64(len(f.blob)) {
+		return nil, errInvalidFlatIndex
+	}
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// validate checks that every id in the index refers to something in it and
+// that the nodes form a tree below the root, so that searching a damaged
+// file cannot read out of bounds or loop forever.
+func (f *FlatIndex) validate() error {
+	last := uint32(0)
+	for id := uint32(0); id <= f.stringCount; id++ {
+		offset := binary.LittleEndian.Uint32(f.offsets[4*uint64(id):])
+		if offset < last {
+			return fmt.Errorf("%w: string %d", errInvalidFlatIndex, id)
+		}
+		last = offset
+	}
+
+	for id := uint32(0); id < f.nodeCount; id++ {
+		first := uint64(f.nodeField(id, flatNodeFirstChild))
+		count := uint64(f.nodeField(id, flatNodeChildCount))
+		dir := f.nodeField(id, flatNodeDir)
+		if f.nodeField(id, flatNodeLabel) >= f.stringCount || f.nodeField(id, flatNodeLink) >= f.stringCount ||
+			first+count > uint64(f.nodeCount) || (dir != flatNoDir && dir >= f.dirCount) {
+			return fmt.Errorf("%w: node %d", errInvalidFlatIndex, id)
+		}
+	}
+
+	// Every node but the root is the child of the node it names as its
+	// parent, so walking down from the root reaches each node once at most.
+	visited := uint64(1)
+	stack := []uint32{f.root}
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		first := f.nodeField(id, flatNodeFirstChild)
+		for c := first; c < first+f.nodeField(id, flatNodeChildCount); c++ {
+			if c == f.root || f.nodeField(c, flatNodeParent) != id {
+				return fmt.Errorf("%w: node %d", errInvalidFlatIndex, c)
+			}
+			stack = append(stack, c)
+			visited++
+		}
+	}
+	if visited != uint64(f.nodeCount) {
+		return fmt.Errorf("%w: %d of %d nodes are below the root", errInvalidFlatIndex, visited, f.nodeCount)
+	}
+
+	for i := uint32(0); i < f.nameCount; i++ {
+		if name := f.name(i); name.key >= f.stringCount || name.node >= f.nodeCount {
+			return fmt.Errorf("%w: name %d", errInvalidFlatIndex, i)
+		}
+	}
+	return nil
+}
+
+// Close unmaps the index. The index must not be used afterwards.
+func (f *FlatIndex) Close() error {
+	if f.data == nil {
+		return nil
+	}
+	err := unmapFile(f.data)
+	f.data = nil
+	return err
+}
+
+// label returns the string with the given id without copying it.
+func (f *FlatIndex) label(id uint32) []byte {
+	start := binary.LittleEndian.Uint32(f.offsets[4*uint64(id):])
+	end := binary.LittleEndian.Uint32(f.offsets[4*uint64(id)+4:])
+	return f.blob[start:end]
+}
+
+// lookupLabel returns the id of s in the string table.
+func (f *FlatIndex) lookupLabel(s string) (uint32, bool) {
+	key := []byte(s)
+	i := sort.Search(int(f.stringCount), func(i int) bool {
+		return bytes.Compare(f.label(uint32(i)), key) >= 0
+	})
+	if i < int(f.stringCount) && string(f.label(uint32(i))) == s {
+		return uint32(i), true
+	}
+	return 0, false
+}
+
+func (f *FlatIndex) node(id uint32) []byte {
+	offset := uint64(id) * flatNodeSize
+	return f.nodes[offset : offset+flatNodeSize]
+}
+
+func (f *FlatIndex) nodeField(id uint32, field int) uint32 {
+	return binary.LittleEndian.Uint32(f.node(id)[field:])
+}
+
+func (f *FlatIndex) nodeModTime(id uint32) int64 {
+	return int64(binary.LittleEndian.Uint64(f.node(id)[flatNodeModTime:]))
+}
+
+func (f *FlatIndex) nodeFileSize(id uint32) int64 {
+	return int64(binary.LittleEndian.Uint64(f.node(id)[flatNodeFileSize:]))
+}
+
+// dirSummary returns the summary of the files below a node, or nil if it has
+// no children.
+func (f *FlatIndex) dirSummary(id uint32) *dirSummary {
+	dir := f.nodeField(id, flatNodeDir)
+	if dir >= f.dirCount {
+		return nil
+	}
+	return decodeDirSummary(f.dirs[uint64(dir)*flatDirSize:])
+}
+
+// nodeLink returns the link target of a node, empty if it is not a link.
+func (f *FlatIndex) nodeLink(id uint32) string {
+	return string(f.label(f.nodeField(id, flatNodeLink)))
+}
+
+func (f *FlatIndex) name(i uint32) flatName {
+	entry := f.names[uint64(i)*flatNameSize:]
+	return flatName{
+		key:  binary.LittleEndian.Uint32(entry),
+		node: binary.LittleEndian.Uint32(entry[4:]),
+	}
+}
+
+// path rebuilds the full path of a node by following its parents.
+func (f *FlatIndex) path(id uint32) string {
+	var parts []string
+	for id != f.root {
+		parts = append(parts, string(f.label(f.nodeField(id, flatNodeLabel))))
+		id = f.nodeField(id, flatNodeParent)
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "/")
+}
+
+// eachFile calls fn with every file in the index and its metadata. Only the
+// path of the file being visited is kept, so the paths are not all built at
+// once.
+func (f *FlatIndex) eachFile(fn func(path string, modTime, size int64, link string)) {
+	var walk func(id uint32, prefix []byte)
+	walk = func(id uint32, prefix []byte) {
+		first := f.nodeField(id, flatNodeFirstChild)
+		count := f.nodeField(id, flatNodeChildCount)
+		for c := first; c < first+count; c++ {
+			path := append(prefix, f.label(f.nodeField(c, flatNodeLabel))...)
+			if f.nodeField(c, flatNodeFlags)&flatFlagEndOfWord != 0 {
+				fn(string(path), f.nodeModTime(c), f.nodeFileSize(c), f.nodeLink(c))
+			}
+			walk(c, append(path, '/'))
+		}
+	}
+	walk(f.root, nil)
+}
+
+func (f *FlatIndex) Search(filename string) []string {
+	results := []string{}
+	key, ok := f.lookupLabel(f.opts.Key(filename))
+	if !ok {
+		return results
+	}
+
+	first := sort.Search(int(f.nameCount), func(i int) bool {
+		return f.name(uint32(i)).key >= key
+	})
+	for i := uint32(first); i < f.nameCount; i++ {
+		name := f.name(i)
+		if name.key != key {
+			break
+		}
+		results = append(results, f.path(name.node))
+	}
+	return results
+}
+
+func (f *FlatIndex) FuzzySearch(filename string, ranker *Ranker) []Match {
+	files := make([]rankCandidate, f.nameCount)
+	for i := uint32(0); i < f.nameCount; i++ {
+		node := f.name(i).node
+		files[i] = rankCandidate{Path: f.path(node), ModTime: f.nodeModTime(node)}
+	}
+	return ranker.Rank(filename, files)
+}
+
+// toTrie decodes the flat index back into a mutable, compressed HybridTrie.
+func (f *FlatIndex) toTrie(t *HybridTrie) {
+	t.IgnoreCase = f.opts.IgnoreCase
+	t.Normalization = f.opts.Normalization
+
+	var build func(id uint32, node *TrieNode)
+	build = func(id uint32, node *TrieNode) {
+		first := f.nodeField(id, flatNodeFirstChild)
+		count := f.nodeField(id, flatNodeChildCount)
+		for c := first; c < first+count; c++ {
+			child := &TrieNode{
+				Children:    make(map[string]*TrieNode),
+				IsEndOfWord: f.nodeField(c, flatNodeFlags)&flatFlagEndOfWord != 0,
+				ModTime:     f.nodeModTime(c),
+				Size:        f.nodeFileSize(c),
+				Link:        f.nodeLink(c),
+			}
+			label := string(f.label(f.nodeField(c, flatNodeLabel)))
+			t.setEdge(child, []string{label})
+			node.Children[label] = child
+			build(c, child)
+		}
+	}
+	t.Root = &TrieNode{
+		Children:    make(map[string]*TrieNode),
+		IsEndOfWord: f.nodeField(f.root, flatNodeFlags)&flatFlagEndOfWord != 0,
+	}
+	build(f.root, t.Root)
+	t.Prune()
+}
@@ -2,14 +2,21 @@ module github.com/vyPal/VFMP/service
 
 go 1.21.1
 
-require github.com/sevlyar/go-daemon v0.1.6
+require (
+	github.com/coreos/go-systemd/v22 v22.5.0
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/sahilm/fuzzy v0.1.0
+	github.com/sevlyar/go-daemon v0.1.6
+	github.com/vyPal/VFMP/vfmpconfig v0.0.0
+	golang.org/x/term v0.10.0
+	golang.org/x/text v0.14.0
+	google.golang.org/protobuf v1.31.0
+)
 
 require (
 	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/joho/godotenv v1.5.1 // indirect
 	github.com/lithammer/fuzzysearch v1.1.8 // indirect
-	github.com/sahilm/fuzzy v0.1.0 // indirect
-	google.golang.org/protobuf v1.31.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	olympos.io/encoding/edn v0.0.0-20201019073823-d3554ca0b0a3 // indirect
 )
@@ -17,6 +24,8 @@ require (
 require (
 	github.com/ilyakaznacheev/cleanenv v1.5.0
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0
 )
+
+replace github.com/vyPal/VFMP/vfmpconfig => ../vfmpconfig
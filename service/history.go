@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// openHistory counts how many times each file was opened, so that fuzzy
+// search can rank files the user opened before higher. It is loaded from the
+// data directory on first use and saved after every change.
+var openHistory struct {
+	sync.Mutex
+	counts map[string]int
+	file   string
+}
+
+// historyFile returns the path of the open history.
+func historyFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "history.gob")
+}
+
+// loadHistory makes sure the history for cfg is loaded. The caller must hold
+// the lock.
+func loadHistory(cfg *ConfigDatabase) error {
+	filename := historyFile(cfg)
+	if openHistory.counts != nil && openHistory.file == filename {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	file, err := os.Open(filename)
+	if err == nil {
+		err = gob.NewDecoder(file).Decode(&counts)
+		file.Close()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	openHistory.counts = counts
+	openHistory.file = filename
+	return nil
+}
+
+// recordOpen adds one to the number of times path was opened.
+func recordOpen(cfg *ConfigDatabase, path string) error {
+	openHistory.Lock()
+	defer openHistory.Unlock()
+
+	if err := loadHistory(cfg); err != nil {
+		return err
+	}
+	openHistory.counts[path]++
+
+	tmpName := openHistory.file + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	err = gob.NewEncoder(file).Encode(openHistory.counts)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, openHistory.file)
+}
+
+// openedCounts returns a copy of the open history.
+func openedCounts(cfg *ConfigDatabase) (map[string]int, error) {
+	openHistory.Lock()
+	defer openHistory.Unlock()
+
+	if err := loadHistory(cfg); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(openHistory.counts))
+	for path, count := range openHistory.counts {
+		counts[path] = count
+	}
+	return counts, nil
+}
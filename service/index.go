@@ -0,0 +1,474 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mappedIndex keeps the flat index mapped between searches, so searching does
+// not have to load the index again. It is remapped when the file changes.
+var mappedIndex struct {
+	sync.RWMutex
+	index *FlatIndex
+	file  string
+	info  os.FileInfo
+}
+
+// unchangedFile reports whether info describes the same file as cached, not
+// rewritten since. Indexes are replaced by renaming a new file over them,
+// which a change of modification time alone can miss when both writes fall
+// within its granularity.
+func unchangedFile(cached, info os.FileInfo) bool {
+	return cached != nil && os.SameFile(cached, info) && cached.Size() == info.Size() && cached.ModTime().Equal(info.ModTime())
+}
+
+// acquireSearcher returns a Searcher for the configured index. The returned
+// release function must be called once the search is done.
+func acquireSearcher(cfg *ConfigDatabase) (Searcher, func(), error) {
+	filename := indexFile(cfg)
+
+	if cfg.Index.Format != FormatFlat {
+		var trie HybridTrie
+		start := time.Now()
+		err := trie.LoadFromFile(filename, cfg.Index.Format)
+		if err != nil {
+			return nil, nil, err
+		}
+		slog.Debug("Trie loaded", "file", filename, "duration", time.Since(start))
+		return &trie, func() {}, nil
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mappedIndex.RLock()
+	if mappedIndex.index != nil && mappedIndex.file == filename && unchangedFile(mappedIndex.info, info) {
+		return mappedIndex.index, mappedIndex.RUnlock, nil
+	}
+	mappedIndex.RUnlock()
+
+	mappedIndex.Lock()
+	if mappedIndex.index == nil || mappedIndex.file != filename || !unchangedFile(mappedIndex.info, info) {
+		start := time.Now()
+		index, err := OpenFlatIndex(filename)
+		if err != nil {
+			mappedIndex.Unlock()
+			return nil, nil, err
+		}
+		if mappedIndex.index != nil {
+			mappedIndex.index.Close()
+		}
+		mappedIndex.index = index
+		mappedIndex.file = filename
+		mappedIndex.info = info
+		slog.Debug("Index mapped", "file", filename, "duration", time.Since(start))
+	}
+	mappedIndex.Unlock()
+
+	// Another writer may swap the index between Unlock and RLock, so retry.
+	return acquireSearcher(cfg)
+}
+
+// loadedNames keeps the name index in memory between searches. It is loaded
+// again when the file changes.
+var loadedNames struct {
+	sync.Mutex
+	index *NameIndex
+	file  string
+	info  os.FileInfo
+}
+
+// acquireNameIndex returns the name index for cfg. The index is shared and
+// must not be modified.
+func acquireNameIndex(cfg *ConfigDatabase) (*NameIndex, error) {
+	filename := nameIndexFile(cfg)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	loadedNames.Lock()
+	defer loadedNames.Unlock()
+	if loadedNames.index != nil && loadedNames.file == filename && unchangedFile(loadedNames.info, info) {
+		return loadedNames.index, nil
+	}
+
+	start := time.Now()
+	index := &NameIndex{}
+	err = index.LoadFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Name index loaded", "file", filename, "duration", time.Since(start))
+
+	loadedNames.index = index
+	loadedNames.file = filename
+	loadedNames.info = info
+	return index, nil
+}
+
+// loadedContent keeps the content index in memory between searches, like
+// loadedNames.
+var loadedContent struct {
+	sync.Mutex
+	index *ContentIndex
+	file  string
+	info  os.FileInfo
+}
+
+// acquireContentIndex returns the content index for cfg. The index is shared
+// and must not be modified.
+func acquireContentIndex(cfg *ConfigDatabase) (*ContentIndex, error) {
+	filename := contentIndexFile(cfg)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	loadedContent.Lock()
+	defer loadedContent.Unlock()
+	if loadedContent.index != nil && loadedContent.file == filename && unchangedFile(loadedContent.info, info) {
+		return loadedContent.index, nil
+	}
+
+	start := time.Now()
+	index := &ContentIndex{}
+	err = index.LoadFromFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Content index loaded", "file", filename, "duration", time.Since(start))
+
+	loadedContent.index = index
+	loadedContent.file = filename
+	loadedContent.info = info
+	return index, nil
+}
+
+// indexLock keeps index runs and updates from writing the index files at the
+// same time.
+var indexLock sync.Mutex
+
+// walkRoot walks root into adder and returns the number of files found.
+// progress, if not nil, is called with the number of files found so far.
+func walkRoot(root Root, adder pathAdder, progress func(count int)) int {
+	count := make(chan int)
+	go walkFiles(root, count, adder)
+	files := 0
+	for c := range count {
+		files = c
+		if progress != nil {
+			progress(c)
+		}
+	}
+	return files
+}
+
+// indexRoots walks every root and replaces the saved indexes with what it
+// found, logging to logger. progress, if not nil, is called with the number
+// of files found so far.
+func indexRoots(roots []Root, cfg *ConfigDatabase, logger *slog.Logger, progress func(count int)) error {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	// Flat indexes are built by streaming sorted runs through the disk, so
+	// the whole tree never has to fit in memory. The name index is built
+	// the same way at the same time, so each gets half of the budget.
+	budget := (cfg.Index.MemoryBudget << 20) / 2
+	trie := NewHybridTrie(nameOptionsFromConfig(cfg))
+	var builder *StreamBuilder
+	var index pathAdder = trie
+	if cfg.Index.Format == FormatFlat {
+		var err error
+		builder, err = NewStreamBuilder(cfg.Data.Dir, budget, nameOptionsFromConfig(cfg))
+		if err != nil {
+			return fmt.Errorf("creating index builder: %w", err)
+		}
+		// Removes the temporary files if the index is not finished.
+		defer builder.Abort()
+		index = builder
+	}
+
+	names, err := NewNameIndexBuilder(cfg.Data.Dir, budget, nameOptionsFromConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("creating name index builder: %w", err)
+	}
+	defer names.Abort()
+	hashes := loadHashCache(hashCacheFile(cfg))
+	adders := pathAdders{index, names, hashes}
+
+	var content *ContentIndex
+	if cfg.Content.Enabled {
+		content = NewContentIndex(contentLimitsFromConfig(cfg))
+		adders = append(adders, content)
+	}
+
+	logger.Info("Start index", "roots", len(roots))
+	start := time.Now()
+	total := 0
+	files := make(map[string]int)
+	for _, root := range roots {
+		files[root.Path] = walkRoot(root, adders, func(c int) {
+			if progress != nil {
+				progress(total + c)
+			}
+		})
+		total += files[root.Path]
+	}
+	diff := time.Since(start)
+	logger.Info("End index", "files", total, "duration", diff)
+	// The walk was cut short, so keep the saved index.
+	if shuttingDown() {
+		return errShuttingDown
+	}
+
+	if builder != nil {
+		err = builder.Finish(indexFile(cfg))
+	} else {
+		err = trie.SaveToFile(indexFile(cfg), cfg.Index.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("saving index: %w", err)
+	}
+	nameIndex, err := names.Build()
+	if err == nil {
+		err = nameIndex.SaveToFile(nameIndexFile(cfg))
+	}
+	if err != nil {
+		return fmt.Errorf("saving name index: %w", err)
+	}
+	if content != nil {
+		err = content.SaveToFile(contentIndexFile(cfg))
+		if err != nil {
+			return fmt.Errorf("saving content index: %w", err)
+		}
+	}
+	pruneHashCache(hashes, nil, cfg)
+
+	// The index now holds these roots and nothing else.
+	err = updateRootRecords(cfg, func(records map[string]rootRecord) {
+		for path := range records {
+			delete(records, path)
+		}
+		for _, root := range roots {
+			if _, ok := findRoot(cfg, root.Path); ok {
+				records[root.Path] = rootRecord{Indexed: time.Now(), Files: files[root.Path]}
+			}
+		}
+	})
+	if err != nil {
+		logger.Error("Error saving root records", "err", err)
+	}
+	return nil
+}
+
+// indexRoot walks root again and replaces its files in the saved indexes,
+// keeping the other roots, logging to logger. progress, if not nil, is
+// called with the number of files found so far.
+func indexRoot(root Root, cfg *ConfigDatabase, logger *slog.Logger, progress func(count int)) error {
+	if _, err := os.Stat(indexFile(cfg)); os.IsNotExist(err) {
+		return indexRoots([]Root{root}, cfg, logger, progress)
+	}
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	files := 0
+	err := rewriteIndexes(cfg, []string{root.Path}, func(adders pathAdders) error {
+		logger.Info("Start index", "root", root.Path)
+		start := time.Now()
+		files = walkRoot(root, adders, progress)
+		logger.Info("End index", "root", root.Path, "files", files, "duration", time.Since(start))
+		if shuttingDown() {
+			return errShuttingDown
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	recordIndexed(cfg, root, files)
+	return nil
+}
+
+// rewriteIndexes drops the files below each of dirs from the saved indexes
+// and then lets walk add files to them, if walk is not nil. The indexes are
+// only saved if walk returns no error. indexLock must be held.
+func rewriteIndexes(cfg *ConfigDatabase, dirs []string, walk func(adders pathAdders) error) error {
+	if cfg.Index.Format == FormatFlat {
+		return rewriteFlatIndex(cfg, dirs, walk)
+	}
+
+	trie, content, err := loadIndexes(cfg)
+	if err != nil {
+		return err
+	}
+	// The directories may not be indexed yet.
+	hashes := loadHashCache(hashCacheFile(cfg))
+	adders := pathAdders{trie, hashes}
+	for _, dir := range dirs {
+		trie.RemoveTree(dir)
+	}
+	if content != nil {
+		for _, dir := range dirs {
+			content.RemoveTree(dir)
+		}
+		adders = append(adders, content)
+	}
+	if walk != nil {
+		if err := walk(adders); err != nil {
+			return err
+		}
+	}
+	if err := saveIndexes(trie, content, cfg); err != nil {
+		return err
+	}
+	if len(dirs) > 0 {
+		pruneHashCache(hashes, dirs, cfg)
+	}
+	return nil
+}
+
+// rewriteFlatIndex is rewriteIndexes for flat indexes. The files of the saved
+// index are streamed into a new one instead of being loaded into a trie, so
+// like indexRoots it only needs the memory budget, however large the index.
+func rewriteFlatIndex(cfg *ConfigDatabase, dirs []string, walk func(adders pathAdders) error) error {
+	budget := (cfg.Index.MemoryBudget << 20) / 2
+	builder, err := NewStreamBuilder(cfg.Data.Dir, budget, nameOptionsFromConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("creating index builder: %w", err)
+	}
+	defer builder.Abort()
+	names, err := NewNameIndexBuilder(cfg.Data.Dir, budget, nameOptionsFromConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("creating name index builder: %w", err)
+	}
+	defer names.Abort()
+
+	old, err := OpenFlatIndex(indexFile(cfg))
+	if err != nil {
+		return fmt.Errorf("opening index: %w", err)
+	}
+	old.eachFile(func(path string, modTime, size int64, link string) {
+		for _, dir := range dirs {
+			dir = strings.TrimSuffix(dir, "/")
+			if path == dir || strings.HasPrefix(path, dir+"/") {
+				return
+			}
+		}
+		builder.add(path, modTime, size, link)
+		names.AddPath(path)
+	})
+	// The index is replaced by Finish, which some systems refuse while it is
+	// mapped.
+	old.Close()
+
+	content := loadContentIndex(cfg)
+	hashes := loadHashCache(hashCacheFile(cfg))
+	adders := pathAdders{builder, names, hashes}
+	if content != nil {
+		for _, dir := range dirs {
+			content.RemoveTree(dir)
+		}
+		adders = append(adders, content)
+	}
+	if walk != nil {
+		if err := walk(adders); err != nil {
+			return err
+		}
+	}
+
+	if err := builder.Finish(indexFile(cfg)); err != nil {
+		return fmt.Errorf("saving index: %w", err)
+	}
+	nameIndex, err := names.Build()
+	if err == nil {
+		err = nameIndex.SaveToFile(nameIndexFile(cfg))
+	}
+	if err != nil {
+		slog.Error("Error saving name index", "err", err)
+	}
+	saveContentIndex(content, cfg)
+	if len(dirs) > 0 {
+		pruneHashCache(hashes, dirs, cfg)
+	}
+	return nil
+}
+
+// saveNameIndex builds the name index from the files in trie and saves it.
+func saveNameIndex(trie *HybridTrie, cfg *ConfigDatabase) error {
+	names, err := NewNameIndexBuilder(cfg.Data.Dir, cfg.Index.MemoryBudget<<20, trie.nameOptions())
+	if err != nil {
+		return err
+	}
+	defer names.Abort()
+	trie.walkHelper(trie.root(), "", func(path string, node *TrieNode) {
+		names.AddPath(path)
+	})
+	index, err := names.Build()
+	if err != nil {
+		return err
+	}
+	return index.SaveToFile(nameIndexFile(cfg))
+}
+
+// loadIndexes loads the saved index to be changed, and the content index if
+// it is enabled and was built.
+func loadIndexes(cfg *ConfigDatabase) (*HybridTrie, *ContentIndex, error) {
+	var trie HybridTrie
+	err := trie.LoadFromFile(indexFile(cfg), cfg.Index.Format)
+	if err != nil {
+		return nil, nil, fmt.Errorf("loading trie: %w", err)
+	}
+
+	return &trie, loadContentIndex(cfg), nil
+}
+
+// loadContentIndex loads the content index to be changed. It returns nil if
+// content indexing is disabled or the index cannot be loaded.
+func loadContentIndex(cfg *ConfigDatabase) *ContentIndex {
+	if !cfg.Content.Enabled {
+		return nil
+	}
+	content := &ContentIndex{}
+	err := content.LoadFromFile(contentIndexFile(cfg))
+	if err != nil {
+		slog.Error("Error loading content index", "err", err)
+		return nil
+	}
+	content.SetLimits(contentLimitsFromConfig(cfg))
+	return content
+}
+
+// saveIndexes saves an index changed in place, along with the name index
+// built from it and the content index, if any.
+func saveIndexes(trie *HybridTrie, content *ContentIndex, cfg *ConfigDatabase) error {
+	err := trie.SaveToFile(indexFile(cfg), cfg.Index.Format)
+	if err != nil {
+		return fmt.Errorf("saving trie: %w", err)
+	}
+
+	// The name index is cheap to rebuild compared to walking again.
+	if err := saveNameIndex(trie, cfg); err != nil {
+		slog.Error("Error saving name index", "err", err)
+	}
+	saveContentIndex(content, cfg)
+	return nil
+}
+
+// saveContentIndex saves a content index changed in place, if there is one.
+func saveContentIndex(content *ContentIndex, cfg *ConfigDatabase) {
+	if content == nil {
+		return
+	}
+	content.Compact()
+	if err := content.SaveToFile(contentIndexFile(cfg)); err != nil {
+		slog.Error("Error saving content index", "err", err)
+	}
+}
@@ -1,73 +1,179 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"time"
 )
 
-func countFiles(root string, status chan<- int) {
-	var count int
+// countFiles counts the files below root the same way walkFiles finds them.
+func countFiles(root Root, status chan<- int) {
+	walkFiles(root, status, pathAdders{})
+}
 
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+// pathAdder receives the files found by walkFiles.
+type pathAdder interface {
+	AddFile(path string, info os.FileInfo)
+}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// pathAdders passes every file on to each of its elements.
+type pathAdders []pathAdder
 
-		if !info.IsDir() {
-			count++
-		}
+func (p pathAdders) AddFile(path string, info os.FileInfo) {
+	for _, adder := range p {
+		adder.AddFile(path, info)
+	}
+}
 
-		select {
-		case <-ticker.C:
-			status <- count
-		default:
-		}
+// linkInfo is a symbolic link that is recorded as a link, with its target.
+type linkInfo struct {
+	os.FileInfo
+	target string
+}
 
-		return nil
-	})
+// linkTarget returns the target of a symbolic link recorded by walkFiles,
+// or an empty string for other files.
+func linkTarget(info os.FileInfo) string {
+	if link, ok := info.(linkInfo); ok {
+		return link.target
+	}
+	return ""
+}
 
+// fileID identifies a file or directory by its device and inode.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// fileWalker walks a root with its options.
+type fileWalker struct {
+	root   Root
+	adder  pathAdder
+	status chan<- int
+	ticker *time.Ticker
+	count  int
+
+	rootDev uint64
+	// Directories that are being walked, so that following a link back
+	// into one of them is detected as a cycle.
+	active map[fileID]bool
+	// Files with several hard links that were already counted.
+	counted map[fileID]bool
+}
+
+// walkFiles walks root.Path, leaving out what the root excludes, and passes
+// every file found to trie. status receives the number of files found so
+// far, where the hard links to a file count once. The walk stops early when
+// the daemon is stopping.
+func walkFiles(root Root, status chan<- int, trie pathAdder) {
+	w := &fileWalker{
+		root:    root,
+		adder:   trie,
+		status:  status,
+		ticker:  time.NewTicker(time.Second),
+		active:  make(map[fileID]bool),
+		counted: make(map[fileID]bool),
+	}
+	defer w.ticker.Stop()
+
+	// The root itself is always followed if it is a link.
+	info, err := os.Stat(root.Path)
 	if err != nil {
-		log.Printf("Failed to walk file system: %v", err)
+		slog.Error("Failed to walk file system", "root", root.Path, "err", err)
+	} else if info.IsDir() {
+		id, _, _ := fileStat(info)
+		w.rootDev = id.dev
+		w.dir(root.Path, info, 0)
+	} else {
+		w.file(root.Path, info)
 	}
 
-	status <- count
+	status <- w.count
 	close(status)
 }
 
-func walkFiles(root string, status chan<- int, trie *HybridTrie) {
-	var count int
-
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+// dir walks the entries of a directory. Directories that cannot be read are
+// logged and skipped.
+func (w *fileWalker) dir(path string, info os.FileInfo, depth int) {
+	if id, _, ok := fileStat(info); ok {
+		if w.active[id] {
+			slog.Warn("Skipping symbolic link cycle", "path", path)
+			return
+		}
+		w.active[id] = true
+		defer delete(w.active, id)
+	}
 
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		slog.Warn("Failed to read directory", "path", path, "err", err)
+	}
+	for _, entry := range entries {
+		if shuttingDown() {
+			return
+		}
+		child := filepath.Join(path, entry.Name())
+		if w.root.excluded(child) {
+			continue
+		}
+		info, err := entry.Info()
 		if err != nil {
-			return err
+			continue
 		}
+		w.entry(child, info, depth+1)
+	}
+}
 
-		if !info.IsDir() {
-			count++
-			trie.AddPath(path)
+// entry handles a file or directory found depth levels below the root.
+func (w *fileWalker) entry(path string, info os.FileInfo, depth int) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		if w.root.Symlinks == SymlinksIgnore {
+			return
+		}
+		followed := false
+		if w.root.Symlinks == SymlinksFollow {
+			if target, err := os.Stat(path); err == nil {
+				info, followed = target, true
+			}
 		}
+		// Links that lead nowhere are recorded even when following.
+		if !followed {
+			target, _ := os.Readlink(path)
+			w.file(path, linkInfo{FileInfo: info, target: target})
+			return
+		}
+	}
 
-		select {
-		case <-ticker.C:
-			status <- count
-		default:
+	if info.IsDir() {
+		if w.root.MaxDepth > 0 && depth >= w.root.MaxDepth {
+			return
+		}
+		if id, _, ok := fileStat(info); ok && w.root.OneFilesystem && id.dev != w.rootDev {
+			return
 		}
+		w.dir(path, info, depth)
+		return
+	}
+	w.file(path, info)
+}
 
-		return nil
-	})
+func (w *fileWalker) file(path string, info os.FileInfo) {
+	w.adder.AddFile(path, info)
 
-	if err != nil {
-		log.Printf("Failed to walk file system: %v", err)
+	// Every path is indexed, but a file with several hard links counts once.
+	id, links, ok := fileStat(info)
+	if !ok || links < 2 || !w.counted[id] {
+		w.count++
+		if ok && links > 1 {
+			w.counted[id] = true
+		}
 	}
 
-	status <- count
-	close(status)
+	select {
+	case <-w.ticker.C:
+		w.status <- w.count
+	default:
+	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	sddaemon "github.com/coreos/go-systemd/v22/daemon"
+)
+
+// shutdownTimeout is how long a stopping daemon waits for running jobs.
+const shutdownTimeout = 30 * time.Second
+
+// errShuttingDown is returned by jobs that were cancelled because the daemon
+// is stopping.
+var errShuttingDown = errors.New("the daemon is shutting down")
+
+// daemonState keeps track of the running jobs, so that the daemon can wait
+// for them before it stops.
+var daemonState struct {
+	sync.Mutex
+	jobs     sync.WaitGroup
+	stopping chan struct{}
+	// Reloads run one at a time.
+	reload sync.Mutex
+}
+
+func init() {
+	daemonState.stopping = make(chan struct{})
+}
+
+// startJob registers a job that stopping waits for. It returns false once
+// the daemon is stopping, in which case the job must not run.
+func startJob() bool {
+	daemonState.Lock()
+	defer daemonState.Unlock()
+	if shuttingDown() {
+		return false
+	}
+	daemonState.jobs.Add(1)
+	return true
+}
+
+// finishJob marks a job started with startJob as done.
+func finishJob() {
+	daemonState.jobs.Done()
+}
+
+// goJob runs fn as a job in a new goroutine, unless the daemon is stopping.
+func goJob(fn func()) {
+	if !startJob() {
+		return
+	}
+	go func() {
+		defer finishJob()
+		fn()
+	}()
+}
+
+// requestShutdown makes the daemon stop. The listener is closed, new jobs
+// are refused and index runs are cancelled without saving.
+func requestShutdown(reason string) {
+	daemonState.Lock()
+	defer daemonState.Unlock()
+	if shuttingDown() {
+		return
+	}
+	slog.Info("Shutting down", "reason", reason)
+	close(daemonState.stopping)
+}
+
+// shuttingDown reports whether the daemon is stopping.
+func shuttingDown() bool {
+	select {
+	case <-daemonState.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleSignals stops the daemon on SIGTERM and SIGINT, and reloads the
+// config on SIGHUP.
+func handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			go func() {
+				if _, err := reloadConfig(); err != nil {
+					slog.Error("Unable to reload config", "err", err)
+				}
+			}()
+			continue
+		}
+		requestShutdown(sig.String())
+	}
+}
+
+// shutdown waits for the running jobs, up to shutdownTimeout, and for the
+// index files to be written. The index stays locked, so nothing writes it
+// while the daemon exits.
+func shutdown() {
+	sddaemon.SdNotify(false, sddaemon.SdNotifyStopping)
+
+	done := make(chan struct{})
+	go func() {
+		if scheduler := indexScheduler.Load(); scheduler != nil {
+			scheduler.Stop()
+		}
+		daemonState.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		slog.Warn("Running jobs did not finish in time, stopping anyway", "timeout", shutdownTimeout)
+	}
+
+	// A job that did not finish may be writing the index, which is only
+	// replaced once it is complete.
+	indexLock.Lock()
+	mappedIndex.Lock()
+	if mappedIndex.index != nil {
+		mappedIndex.index.Close()
+		mappedIndex.index = nil
+	}
+	mappedIndex.Unlock()
+
+	slog.Info("daemon stopped")
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log formats.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// logLevel is the level of the daemon log, which changes when the config is
+// reloaded.
+var logLevel slog.LevelVar
+
+// logFile is the rotated log of the daemon, nil when logging to stderr.
+var logFile *rotatingFile
+
+// Counters for the ids that tie log records to a connection, a request or a
+// job.
+var connectionIDs, requestIDs, jobIDs atomic.Uint64
+
+// validLog checks the log settings and reports every problem found.
+func validLog(cfg *ConfigDatabase) error {
+	var errs []error
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %q is not debug, info, warn or error", cfg.Log.Level))
+	}
+	if cfg.Log.Format != LogText && cfg.Log.Format != LogJSON {
+		errs = append(errs, fmt.Errorf("log.format: %q is not text or json", cfg.Log.Format))
+	}
+	if cfg.Log.MaxSize < 0 || cfg.Log.MaxAge < 0 || cfg.Log.MaxFiles < 0 {
+		errs = append(errs, errors.New("log: max_size_mb, max_age_days and max_files must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// setupLogging sends the log of the daemon, including what is written with
+// the log package, to w with the configured level and format. With w nil
+// the log goes to vfmpd.log in the data directory, which is rotated.
+func setupLogging(cfg *ConfigDatabase, w io.Writer) error {
+	if w == nil {
+		file, err := openRotatingFile(logFileName(cfg), rotationFromConfig(cfg))
+		if err != nil {
+			return err
+		}
+		logFile = file
+		w = file
+	}
+
+	logLevel.UnmarshalText([]byte(cfg.Log.Level))
+	opts := &slog.HandlerOptions{Level: &logLevel}
+	var handler slog.Handler = slog.NewTextHandler(w, opts)
+	if cfg.Log.Format == LogJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// reloadLogging applies the level and rotation settings of a reloaded
+// config. The format only changes on restart.
+func reloadLogging(cfg *ConfigDatabase) {
+	logLevel.UnmarshalText([]byte(cfg.Log.Level))
+	if logFile != nil {
+		logFile.setRotation(rotationFromConfig(cfg))
+	}
+}
+
+// logFileName returns the path of the daemon log.
+func logFileName(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "vfmpd.log")
+}
+
+// clientConn is a client connection with the logger for its current
+// request.
+type clientConn struct {
+	net.Conn
+	log *slog.Logger
+}
+
+// connLog returns the logger for the request being handled on conn.
+func connLog(conn net.Conn) *slog.Logger {
+	if c, ok := conn.(*clientConn); ok {
+		return c.log
+	}
+	return slog.Default()
+}
+
+// jobLog returns a logger for a new job, like an index run.
+func jobLog(logger *slog.Logger, kind string) *slog.Logger {
+	return logger.With("job", jobIDs.Add(1), "kind", kind)
+}
+
+// rotation decides when a log file is rotated.
+type rotation struct {
+	// Rotate once the file is larger, 0 for no limit
+	maxSize int64
+	// Rotate once the file is older, 0 for no limit
+	maxAge time.Duration
+	// Rotated files to keep as name.1, name.2 and so on
+	maxFiles int
+}
+
+func rotationFromConfig(cfg *ConfigDatabase) rotation {
+	return rotation{
+		maxSize:  int64(cfg.Log.MaxSize) << 20,
+		maxAge:   time.Duration(cfg.Log.MaxAge) * 24 * time.Hour,
+		maxFiles: cfg.Log.MaxFiles,
+	}
+}
+
+// rotatingFile is a log file that is moved aside once it is too large or
+// too old. Its age is counted from when it was opened.
+type rotatingFile struct {
+	mu     sync.Mutex
+	name   string
+	limits rotation
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// openRotatingFile opens the log file name for appending. A file left from
+// before that is already too old is rotated first.
+func openRotatingFile(name string, limits rotation) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, limits: limits}
+	if info, err := os.Stat(name); err == nil && limits.maxAge > 0 && time.Since(info.ModTime()) > limits.maxAge {
+		r.shift()
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) setRotation(limits rotation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limits = limits
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tooLarge := r.limits.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.limits.maxSize
+	tooOld := r.limits.maxAge > 0 && time.Since(r.opened) > r.limits.maxAge
+	if tooLarge || tooOld {
+		r.file.Close()
+		r.shift()
+		if err := r.open(); err != nil {
+			// Keep logging somewhere rather than losing everything.
+			fmt.Fprintln(os.Stderr, "Unable to open the log file after rotating it:", err)
+			return os.Stderr.Write(p)
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// shift moves the log to name.1, name.1 to name.2 and so on, dropping the
+// files beyond maxFiles.
+func (r *rotatingFile) shift() {
+	if r.limits.maxFiles == 0 {
+		os.Remove(r.name)
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.name, r.limits.maxFiles))
+	for i := r.limits.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+	if err := os.Rename(r.name, r.name+".1"); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "Unable to rotate the log file:", err)
+	}
+}
+
+// Close closes the log file.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -3,10 +3,14 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 )
 
@@ -25,44 +29,106 @@ type IndexRequest struct {
 	UpdateFreq float32 `json:"ufreq" default:"10"`
 }
 
+// UpdateRequest applies file system changes to the saved index without walking again.
+type UpdateRequest struct {
+	Add        []string   `json:"add"`
+	Remove     []string   `json:"remove"`
+	RemoveTree []string   `json:"remove_tree"`
+	Rename     []RenameOp `json:"rename"`
+}
+
+// OpenRequest tells the daemon that the user opened a file, which ranks it
+// higher in fuzzy search.
+type OpenRequest struct {
+	Path string `json:"path"`
+}
+
+// ContentSearchRequest searches the words inside indexed text files.
+type ContentSearchRequest struct {
+	SearchString string `json:"search"`
+	MaxResults   int    `json:"max" default:"10"`
+}
+
+// DedupeRequest looks for duplicate files below the given indexed
+// directories, or in the whole index if there are none.
+type DedupeRequest struct {
+	Dirs []string `json:"dirs"`
+}
+
+// UsageRequest asks for the disk usage below an indexed directory, or of the
+// whole index if Dir is empty, listing subdirectories down to Depth levels.
+type UsageRequest struct {
+	Dir   string `json:"dir"`
+	Depth int    `json:"depth" default:"1"`
+	Top   int    `json:"top" default:"10"`
+}
+
+type RenameOp struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// SearchRequest searches the index in one of the search modes. A MaxResults
+// of zero returns every result, whatever the mode.
 type SearchRequest struct {
 	Dir          string `json:"dir"`
 	SearchString string `json:"search"`
 	FuzzySearch  bool   `json:"fuzzy" default:"false"`
+	Mode         string `json:"mode" default:"exact"`
+	MaxDistance  int    `json:"distance" default:"2"`
 	MinScore     int    `json:"score" default:"0"`
 	MaxResults   int    `json:"max" default:"10"`
 }
 
 func setupIPCServer(cfg *ConfigDatabase) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Server.Port))
+	listener, err := listen(cfg)
 	if err != nil {
 		log.Fatal("Unable to listen: ", err)
 	}
 	defer listener.Close()
 
-	log.Printf("IPC server listening on port %d", cfg.Server.Port)
+	slog.Info("IPC server listening", "addr", listener.Addr().String())
+	notifyReady(listener.Addr())
+
+	go func() {
+		<-daemonState.stopping
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Print("Error accepting connection: ", err)
+			if shuttingDown() {
+				return
+			}
+			slog.Error("Error accepting connection", "err", err)
 			continue
 		}
+		daemonMetrics.connectionOpened()
 
-		go handleConnection(conn, cfg)
+		logger := slog.With("conn", connectionIDs.Add(1), "remote", conn.RemoteAddr().String())
+		go handleConnection(&clientConn{Conn: conn, log: logger})
 	}
 }
 
-func handleConnection(conn net.Conn, cfg *ConfigDatabase) {
+func handleConnection(conn *clientConn) {
 	defer conn.Close()
+	defer daemonMetrics.connectionClosed()
 
-	log.Print("New connection established")
+	conn.log.Debug("New connection established")
 
+	// One reader for the connection, so messages sent together are kept.
+	reader := bufio.NewReader(conn)
+	logger := conn.log
 	for {
 		// Read incoming message
-		msg, err := bufio.NewReader(conn).ReadString('\n')
+		msg, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			conn.log.Debug("Connection closed")
+			return
+		}
 		if err != nil {
-			log.Print("Error reading message: ", err)
+			conn.log.Error("Error reading message", "err", err)
 			return
 		}
 
@@ -70,36 +136,48 @@ func handleConnection(conn net.Conn, cfg *ConfigDatabase) {
 		var data map[string]interface{}
 		err = json.Unmarshal([]byte(msg), &data)
 		if err != nil {
-			log.Print("Error unmarshaling message: ", err)
+			connLog(conn).Error("Error unmarshaling message", "err", err)
 			return
 		}
 
-		processMessage(msg, conn, cfg)
+		// Messages that arrive while the daemon is stopping are dropped.
+		if !startJob() {
+			return
+		}
+		// Each message is answered with the config running when it arrived.
+		processMessage(msg, conn, runningConfig.Load())
+		finishJob()
+		// Later requests get their own fields.
+		conn.log = logger
 	}
 }
 
-func processMessage(msg string, conn net.Conn, cfg *ConfigDatabase) {
+func processMessage(msg string, conn *clientConn, cfg *ConfigDatabase) {
 	var m IPCMessage
 	err := json.Unmarshal([]byte(msg), &m)
 	if err != nil {
-		log.Print("Error unmarshaling message: ", err)
+		conn.log.Error("Error unmarshaling message", "err", err)
 		return
 	}
+	conn.log = conn.log.With("request", requestIDs.Add(1), "type", m.Type)
+
+	timer := daemonMetrics.startJob(m.Type)
+	defer timer.done()
 
 	switch m.Type {
 	case "count":
 		var r CountRequest
 		err = json.Unmarshal([]byte(m.Data), &r)
 		if err != nil {
-			log.Print("Error unmarshaling data: ", err)
+			connLog(conn).Error("Error unmarshaling data", "err", err)
 			return
 		}
-		processCount(r, conn)
+		processCount(r, conn, cfg)
 	case "index":
 		var r IndexRequest
 		err = json.Unmarshal([]byte(m.Data), &r)
 		if err != nil {
-			log.Print("Error unmarshaling data: ", err)
+			connLog(conn).Error("Error unmarshaling data", "err", err)
 			return
 		}
 		processIndex(r, conn, cfg)
@@ -107,21 +185,74 @@ func processMessage(msg string, conn net.Conn, cfg *ConfigDatabase) {
 		var r SearchRequest
 		err = json.Unmarshal([]byte(m.Data), &r)
 		if err != nil {
-			log.Print("Error unmarshaling data: ", err)
+			connLog(conn).Error("Error unmarshaling data", "err", err)
 			return
 		}
 		processSearch(r, conn, cfg)
+	case "search.content":
+		var r ContentSearchRequest
+		err = json.Unmarshal([]byte(m.Data), &r)
+		if err != nil {
+			connLog(conn).Error("Error unmarshaling data", "err", err)
+			return
+		}
+		processContentSearch(r, conn, cfg)
+	case "update":
+		var r UpdateRequest
+		err = json.Unmarshal([]byte(m.Data), &r)
+		if err != nil {
+			connLog(conn).Error("Error unmarshaling data", "err", err)
+			return
+		}
+		processUpdate(r, conn, cfg)
+	case "open":
+		var r OpenRequest
+		err = json.Unmarshal([]byte(m.Data), &r)
+		if err != nil {
+			connLog(conn).Error("Error unmarshaling data", "err", err)
+			return
+		}
+		processOpen(r, conn, cfg)
+	case "dedupe":
+		var r DedupeRequest
+		err = json.Unmarshal([]byte(m.Data), &r)
+		if err != nil {
+			connLog(conn).Error("Error unmarshaling data", "err", err)
+			return
+		}
+		processDedupe(r, conn, cfg)
+	case "usage":
+		var r UsageRequest
+		err = json.Unmarshal([]byte(m.Data), &r)
+		if err != nil {
+			connLog(conn).Error("Error unmarshaling data", "err", err)
+			return
+		}
+		processUsage(r, conn, cfg)
+	case "schedule":
+		processSchedule(conn)
+	case "roots":
+		processRoots(conn, cfg)
+	case "status":
+		processStatus(conn, cfg)
+	case "stats":
+		processStats(conn, cfg)
+	case "config.get":
+		processConfigGet(conn, cfg)
+	case "config.reload":
+		processConfigReload(conn)
 	case "ping":
 		processPing(conn)
 	case "kill":
 		processKill(m, conn)
 	default:
-		log.Print("Unknown message type: ", m.Type)
+		timer.discard()
+		conn.log.Warn("Unknown message type")
 	}
 }
 
 func processPing(conn net.Conn) {
-	log.Print("Received ping message")
+	connLog(conn).Debug("Received ping message")
 
 	// Send pong message
 	pong := IPCMessage{
@@ -130,32 +261,33 @@ func processPing(conn net.Conn) {
 
 	pongData, err := json.Marshal(pong)
 	if err != nil {
-		log.Print("Error marshaling pong message: ", err)
+		connLog(conn).Error("Error marshaling pong message", "err", err)
 		return
 	}
 
-	_, err = conn.Write(pongData)
+	_, err = conn.Write(append(pongData, '\n'))
 	if err != nil {
-		log.Print("Error writing pong message: ", err)
+		connLog(conn).Error("Error writing pong message", "err", err)
 		return
 	}
 }
 
 func processKill(req IPCMessage, conn net.Conn) {
-	log.Print("Received kill message")
-
-	if req.Data != "" {
-		log.Print("Kill reason: ", req.Data)
-	}
+	connLog(conn).Info("Received kill message", "reason", req.Data)
 
-	os.Exit(0)
+	requestShutdown("kill message")
 }
 
-func processCount(req CountRequest, conn net.Conn) {
-	log.Print("Count: ", req.Dir)
+func processCount(req CountRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Count", "dir", req.Dir)
 
+	// Roots are counted with their options, like they are indexed.
+	root, ok := findRoot(cfg, req.Dir)
+	if !ok {
+		root = Root{Path: filepath.Clean(req.Dir), Symlinks: SymlinksRecord}
+	}
 	count := make(chan int)
-	go countFiles(req.Dir, count)
+	go countFiles(root, count)
 
 	// When a new value is received on the channel, send it as an json object with type "count.progress"
 	for c := range count {
@@ -165,7 +297,7 @@ func processCount(req CountRequest, conn net.Conn) {
 		}
 		data, err := json.Marshal(msg)
 		if err != nil {
-			log.Print("Error marshaling message: ", err)
+			connLog(conn).Error("Error marshaling message", "err", err)
 			return
 		}
 		conn.Write(data)
@@ -178,7 +310,7 @@ func processCount(req CountRequest, conn net.Conn) {
 	}
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Print("Error marshaling message: ", err)
+		connLog(conn).Error("Error marshaling message", "err", err)
 		return
 	}
 
@@ -187,30 +319,37 @@ func processCount(req CountRequest, conn net.Conn) {
 }
 
 func processIndex(req IndexRequest, conn net.Conn, cfg *ConfigDatabase) {
-	log.Print("Index: ", req.Dir)
-
-	count := make(chan int)
-	var trie HybridTrie
-	log.Print("Start index")
-	start := time.Now()
-	go walkFiles(req.Dir, count, &trie)
+	logger := jobLog(connLog(conn), "index")
+	logger.Info("Index", "dir", req.Dir)
 
 	// When a new value is received on the channel, send it as an json object with type "index.progress"
-	for c := range count {
+	progress := func(c int) {
 		msg := IPCMessage{
 			Type: "index.progress",
 			Data: fmt.Sprintf("%d", c),
 		}
 		data, err := json.Marshal(msg)
 		if err != nil {
-			log.Print("Error marshaling message: ", err)
+			connLog(conn).Error("Error marshaling message", "err", err)
 			return
 		}
 		conn.Write(data)
 		conn.Write([]byte("\n"))
 	}
-	diff := time.Since(start)
-	log.Print("End index. Took ", diff.Milliseconds(), "ms")
+
+	// Without a directory every configured root is indexed again. Other
+	// directories are indexed with the default options.
+	var err error
+	if req.Dir == "" {
+		err = indexRoots(cfg.Roots, cfg, logger, progress)
+	} else if root, ok := findRoot(cfg, req.Dir); ok {
+		err = indexRoot(root, cfg, logger, progress)
+	} else {
+		err = indexRoot(Root{Path: filepath.Clean(req.Dir), Symlinks: SymlinksRecord}, cfg, logger, progress)
+	}
+	if err != nil {
+		logger.Error("Error indexing", "err", err)
+	}
 
 	// Send a message with type "index.done"
 	msg := IPCMessage{
@@ -218,53 +357,348 @@ func processIndex(req IndexRequest, conn net.Conn, cfg *ConfigDatabase) {
 	}
 	data, err := json.Marshal(msg)
 	if err != nil {
-		log.Print("Error marshaling message: ", err)
+		connLog(conn).Error("Error marshaling message", "err", err)
 		return
 	}
 
 	conn.Write(data)
 	conn.Write([]byte("\n"))
+}
+
+func processUpdate(req UpdateRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Update", "added", len(req.Add), "removed", len(req.Remove), "trees_removed", len(req.RemoveTree), "renamed", len(req.Rename))
+
+	indexLock.Lock()
+	defer indexLock.Unlock()
 
-	trie.SaveToFile(cfg.Data.Dir + "/trie.gob")
+	// The content index is only updated if it was built.
+	trie, content, err := loadIndexes(cfg)
+	if err != nil {
+		connLog(conn).Error("Error loading indexes", "err", err)
+		sendJSON(conn, "update.error", err.Error())
+		return
+	}
+
+	// Missing paths are only logged, the index may already be out of date.
+	for _, path := range req.Remove {
+		if err := trie.RemovePath(path); err != nil {
+			connLog(conn).Error("Error removing", "path", path, "err", err)
+		}
+		if content != nil {
+			content.Remove(path)
+		}
+	}
+	for _, dir := range req.RemoveTree {
+		if err := trie.RemoveTree(dir); err != nil {
+			connLog(conn).Error("Error removing", "path", dir, "err", err)
+		}
+		if content != nil {
+			content.RemoveTree(dir)
+		}
+	}
+	for _, op := range req.Rename {
+		if err := trie.RenamePath(op.From, op.To); err != nil {
+			connLog(conn).Error("Error renaming", "from", op.From, "to", op.To, "err", err)
+		}
+		if content != nil {
+			content.Rename(op.From, op.To)
+		}
+	}
+	for _, path := range req.Add {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Keep the path without metadata, the file may be back later.
+			connLog(conn).Error("Error reading", "path", path, "err", err)
+			trie.AddPath(path)
+			continue
+		}
+		trie.AddFile(path, info)
+		if content != nil {
+			content.AddFile(path, info)
+		}
+	}
+
+	err = saveIndexes(trie, content, cfg)
+	if err != nil {
+		connLog(conn).Error("Error saving indexes", "err", err)
+		sendJSON(conn, "update.error", err.Error())
+		return
+	}
+
+	msg := IPCMessage{
+		Type: "update.done",
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		connLog(conn).Error("Error marshaling message", "err", err)
+		return
+	}
+
+	conn.Write(data)
+	conn.Write([]byte("\n"))
 }
 
-func processSearch(req SearchRequest, conn net.Conn, cfg *ConfigDatabase) {
-	log.Print("Search: ", req.SearchString)
+func processDedupe(req DedupeRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Dedupe", "dirs", req.Dirs)
+
+	var trie HybridTrie
+	err := trie.LoadFromFile(indexFile(cfg), cfg.Index.Format)
+	if err != nil {
+		connLog(conn).Error("Error loading trie", "err", err)
+		sendJSON(conn, "dedupe.error", err.Error())
+		return
+	}
+	files, err := trie.filesBelow(req.Dirs)
+	if err != nil {
+		connLog(conn).Error("Error listing files", "err", err)
+		sendJSON(conn, "dedupe.error", err.Error())
+		return
+	}
+
+	cache := loadHashCache(hashCacheFile(cfg))
+	start := time.Now()
+	report := findDuplicates(files, cache, throttle(time.Second, func(p DedupeProgress) {
+		sendJSON(conn, "dedupe.progress", p)
+	}))
+	connLog(conn).Info("Dedupe done", "sets", len(report.Sets), "duration", time.Since(start))
+
+	indexed := make(map[string]bool, len(files))
+	for _, f := range files {
+		indexed[f.path] = true
+	}
+	cache.prune(req.Dirs, indexed)
+	err = cache.SaveToFile(hashCacheFile(cfg))
+	if err != nil {
+		connLog(conn).Error("Error saving hash cache", "err", err)
+	}
+
+	sendJSON(conn, "dedupe.done", report)
+}
+
+func processRoots(conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Roots")
+	sendJSON(conn, "roots.list", listRoots(cfg))
+}
+
+func processSchedule(conn net.Conn) {
+	connLog(conn).Info("Schedule status")
+
+	status := []ScheduleStatus{}
+	if scheduler := indexScheduler.Load(); scheduler != nil {
+		status = scheduler.Status()
+	}
+	sendJSON(conn, "schedule.status", status)
+}
+
+func processUsage(req UsageRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Usage", "dir", req.Dir, "depth", req.Depth)
 
 	var trie HybridTrie
+	err := trie.LoadFromFile(indexFile(cfg), cfg.Index.Format)
+	if err != nil {
+		connLog(conn).Error("Error loading trie", "err", err)
+		sendJSON(conn, "usage.error", err.Error())
+		return
+	}
+	if req.Top <= 0 {
+		req.Top = 10
+	}
+
 	start := time.Now()
-	err := trie.LoadFromFile(cfg.Data.Dir + "/trie.gob")
+	report, err := trie.Usage(req.Dir, req.Depth, req.Top)
 	if err != nil {
-		log.Print("Error loading trie: ", err)
+		connLog(conn).Error("Error computing usage", "err", err)
+		sendJSON(conn, "usage.error", err.Error())
 		return
 	}
+	connLog(conn).Info("Usage done", "files", report.Files, "duration", time.Since(start))
+
+	sendJSON(conn, "usage.done", report)
+}
+
+// sendJSON sends a message whose data is v encoded as JSON.
+func sendJSON(conn net.Conn, msgType string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		connLog(conn).Error("Error marshaling data", "err", err)
+		return
+	}
+	msg, err := json.Marshal(IPCMessage{
+		Type: msgType,
+		Data: string(data),
+	})
+	if err != nil {
+		connLog(conn).Error("Error marshaling message", "err", err)
+		return
+	}
+
+	conn.Write(msg)
+	conn.Write([]byte("\n"))
+}
+
+func processOpen(req OpenRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Open", "path", req.Path)
+
+	err := recordOpen(cfg, req.Path)
+	if err != nil {
+		connLog(conn).Error("Error saving open history", "err", err)
+	}
+
+	msg := IPCMessage{
+		Type: "open.done",
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		connLog(conn).Error("Error marshaling message", "err", err)
+		return
+	}
+
+	conn.Write(data)
+	conn.Write([]byte("\n"))
+}
+
+func processSearch(req SearchRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Search", "query", req.SearchString, "mode", req.Mode)
 
-	diff := time.Since(start)
-	log.Print("Trie load took ", diff.Milliseconds(), "ms")
-	start = time.Now()
-	encoder := json.NewEncoder(conn)
 	if req.FuzzySearch {
-		res := trie.FuzzySearch(req.SearchString)
-		if len(res) > req.MaxResults {
-			res = res[:req.MaxResults]
+		req.Mode = SearchFuzzy
+	}
+
+	var res interface{}
+	var start time.Time
+	switch req.Mode {
+	case SearchPrefix, SearchSuffix, SearchContains:
+		names, err := acquireNameIndex(cfg)
+		if err != nil {
+			connLog(conn).Error("Error loading name index", "err", err)
+			sendSearchError(conn, err)
+			return
 		}
-		diff := time.Since(start)
-		log.Print("Search took ", diff.Milliseconds(), "ms")
-		err := encoder.Encode(res)
+		start = time.Now()
+		res = names.Find(req.Mode, req.SearchString, req.MaxResults)
+	case SearchTypo:
+		names, err := acquireNameIndex(cfg)
 		if err != nil {
-			log.Printf("Error encoding fuzzy search results: %v", err)
+			connLog(conn).Error("Error loading name index", "err", err)
+			sendSearchError(conn, err)
+			return
 		}
-	} else {
-		res := trie.Search(req.SearchString)
-		if len(res) > req.MaxResults {
-			res = res[:req.MaxResults]
+		if req.MaxDistance <= 0 {
+			req.MaxDistance = DefaultMaxDistance
 		}
-		diff := time.Since(start)
-		log.Print("Search took ", diff.Milliseconds(), "ms")
-		err := encoder.Encode(res)
+		start = time.Now()
+		res = names.FindTypos(req.SearchString, req.MaxDistance, req.MaxResults)
+	case SearchQuery:
+		query, err := ParseQuery(req.SearchString, time.Now())
 		if err != nil {
-			log.Printf("Error encoding search results: %v", err)
+			connLog(conn).Error("Invalid query", "err", err)
+			sendSearchError(conn, err)
+			return
+		}
+		index, release, err := acquireSearcher(cfg)
+		if err != nil {
+			connLog(conn).Error("Error loading index", "err", err)
+			sendSearchError(conn, err)
+			return
+		}
+		defer release()
+
+		start = time.Now()
+		res = index.Query(query, req.MaxResults)
+	case SearchFuzzy, SearchExact, "":
+		index, release, err := acquireSearcher(cfg)
+		if err != nil {
+			connLog(conn).Error("Error loading index", "err", err)
+			sendSearchError(conn, err)
+			return
 		}
+		defer release()
+
+		start = time.Now()
+		if req.Mode == SearchFuzzy {
+			opened, err := openedCounts(cfg)
+			if err != nil {
+				connLog(conn).Error("Error loading open history", "err", err)
+			}
+			ranker := &Ranker{
+				Weights: rankWeightsFromConfig(cfg),
+				Opened:  opened,
+				Now:     time.Now(),
+			}
+			matches := index.FuzzySearch(req.SearchString, ranker)
+			if req.MaxResults > 0 && len(matches) > req.MaxResults {
+				matches = matches[:req.MaxResults]
+			}
+			res = matches
+		} else {
+			paths := index.Search(req.SearchString)
+			if req.MaxResults > 0 && len(paths) > req.MaxResults {
+				paths = paths[:req.MaxResults]
+			}
+			res = paths
+		}
+	default:
+		connLog(conn).Warn("Unknown search mode", "mode", req.Mode)
+		sendSearchError(conn, fmt.Errorf("unknown search mode %q", req.Mode))
+		return
+	}
+	diff := time.Since(start)
+	connLog(conn).Info("Search done", "duration", diff)
+	if req.Mode == "" {
+		req.Mode = SearchExact
+	}
+	daemonMetrics.observeSearch(req.Mode, diff)
+
+	encoder := json.NewEncoder(conn)
+	err := encoder.Encode(res)
+	if err != nil {
+		connLog(conn).Error("Error encoding search results", "err", err)
 	}
 	conn.Write([]byte("\n"))
 }
+
+func processContentSearch(req ContentSearchRequest, conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Content search", "query", req.SearchString)
+
+	if !cfg.Content.Enabled {
+		sendSearchError(conn, errors.New("content indexing is disabled"))
+		return
+	}
+	index, err := acquireContentIndex(cfg)
+	if err != nil {
+		connLog(conn).Error("Error loading content index", "err", err)
+		sendSearchError(conn, err)
+		return
+	}
+
+	start := time.Now()
+	res := index.Search(req.SearchString, req.MaxResults)
+	diff := time.Since(start)
+	connLog(conn).Info("Content search done", "duration", diff)
+	daemonMetrics.observeSearch("content", diff)
+
+	encoder := json.NewEncoder(conn)
+	err = encoder.Encode(res)
+	if err != nil {
+		connLog(conn).Error("Error encoding search results", "err", err)
+	}
+	conn.Write([]byte("\n"))
+}
+
+// sendSearchError answers a search that could not be run, like a query with
+// a syntax error or a missing index, with a "search.error" message instead of
+// results.
+func sendSearchError(conn net.Conn, searchErr error) {
+	msg := IPCMessage{
+		Type: "search.error",
+		Data: searchErr.Error(),
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		connLog(conn).Error("Error marshaling message", "err", err)
+		return
+	}
+
+	conn.Write(data)
+	conn.Write([]byte("\n"))
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the search latency histograms, in
+// seconds.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// daemonMetrics counts what the daemon did since it started.
+var daemonMetrics = metrics{
+	jobs:     make(map[string]*jobMetrics),
+	searches: make(map[string]*latencyHistogram),
+}
+
+type metrics struct {
+	mu sync.Mutex
+
+	openConnections  int64
+	totalConnections int64
+	// By message type, and "index.scheduled" for scheduled runs
+	jobs map[string]*jobMetrics
+	// By search mode
+	searches map[string]*latencyHistogram
+}
+
+type jobMetrics struct {
+	count   int64
+	running int64
+	total   time.Duration
+	last    time.Duration
+}
+
+type latencyHistogram struct {
+	// counts[i] is the number of searches that took at most
+	// latencyBuckets[i] and more than the bucket before.
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func (m *metrics) connectionOpened() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.openConnections++
+	m.totalConnections++
+}
+
+func (m *metrics) connectionClosed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.openConnections--
+}
+
+// jobTimer measures one job, see metrics.startJob.
+type jobTimer struct {
+	m     *metrics
+	name  string
+	start time.Time
+	ended bool
+}
+
+// startJob counts a job as running until done or discard is called on the
+// returned timer.
+func (m *metrics) startJob(name string) *jobTimer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job := m.jobs[name]
+	if job == nil {
+		job = &jobMetrics{}
+		m.jobs[name] = job
+	}
+	job.running++
+	return &jobTimer{m: m, name: name, start: time.Now()}
+}
+
+// done records the job as finished.
+func (t *jobTimer) done() {
+	if t.ended {
+		return
+	}
+	t.ended = true
+	elapsed := time.Since(t.start)
+
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	job := t.m.jobs[t.name]
+	job.running--
+	job.count++
+	job.total += elapsed
+	job.last = elapsed
+}
+
+// discard forgets the job, for messages that turn out not to be jobs.
+func (t *jobTimer) discard() {
+	if t.ended {
+		return
+	}
+	t.ended = true
+
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	job := t.m.jobs[t.name]
+	job.running--
+	if job.count == 0 && job.running == 0 {
+		delete(t.m.jobs, t.name)
+	}
+}
+
+// observeSearch records how long a search in mode took.
+func (m *metrics) observeSearch(mode string, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.searches[mode]
+	if h == nil {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets))}
+		m.searches[mode] = h
+	}
+	h.count++
+	h.sum += elapsed
+	for i, bound := range latencyBuckets {
+		if elapsed.Seconds() <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// DaemonStats describes what the daemon is doing and did since it started,
+// as sent to clients.
+type DaemonStats struct {
+	Uptime      time.Duration
+	Connections ConnectionStats
+	Memory      MemoryStats
+	Indexes     []IndexStatus
+	Jobs        map[string]JobStats
+	Searches    map[string]LatencyStats
+}
+
+type ConnectionStats struct {
+	Open  int64
+	Total int64
+}
+
+type MemoryStats struct {
+	// Bytes of allocated heap objects
+	Alloc uint64
+	// Bytes obtained from the system
+	Sys        uint64
+	NumGC      uint32
+	Goroutines int
+}
+
+type JobStats struct {
+	Count         int64
+	Running       int64
+	TotalDuration time.Duration
+	LastDuration  time.Duration
+}
+
+// LatencyStats is a histogram of how long searches took.
+type LatencyStats struct {
+	Count uint64
+	Sum   time.Duration
+	// Cumulative, like Prometheus histograms
+	Buckets []LatencyBucket
+}
+
+type LatencyBucket struct {
+	// Upper bound in seconds
+	LE    float64
+	Count uint64
+}
+
+func processStats(conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Stats")
+	sendJSON(conn, "stats", collectStats(cfg))
+}
+
+// collectStats returns the current stats of the daemon.
+func collectStats(cfg *ConfigDatabase) DaemonStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := DaemonStats{
+		Uptime: time.Since(daemonStarted).Round(time.Second),
+		Memory: MemoryStats{
+			Alloc:      mem.Alloc,
+			Sys:        mem.Sys,
+			NumGC:      mem.NumGC,
+			Goroutines: runtime.NumGoroutine(),
+		},
+		Indexes:  daemonStatus(cfg).Indexes,
+		Jobs:     make(map[string]JobStats),
+		Searches: make(map[string]LatencyStats),
+	}
+
+	m := &daemonMetrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats.Connections = ConnectionStats{Open: m.openConnections, Total: m.totalConnections}
+	for name, job := range m.jobs {
+		stats.Jobs[name] = JobStats{
+			Count:         job.count,
+			Running:       job.running,
+			TotalDuration: job.total,
+			LastDuration:  job.last,
+		}
+	}
+	for mode, h := range m.searches {
+		latency := LatencyStats{Count: h.count, Sum: h.sum}
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			latency.Buckets = append(latency.Buckets, LatencyBucket{LE: bound, Count: cumulative})
+		}
+		stats.Searches[mode] = latency
+	}
+	return stats
+}
+
+// writePrometheus writes stats in the Prometheus text format.
+func writePrometheus(w io.Writer, stats DaemonStats) {
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	metric("vfmpd_uptime_seconds", "gauge", "Time since the daemon started.")
+	fmt.Fprintf(w, "vfmpd_uptime_seconds %g\n", stats.Uptime.Seconds())
+
+	metric("vfmpd_connections_open", "gauge", "Open client connections.")
+	fmt.Fprintf(w, "vfmpd_connections_open %d\n", stats.Connections.Open)
+	metric("vfmpd_connections_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(w, "vfmpd_connections_total %d\n", stats.Connections.Total)
+
+	metric("vfmpd_memory_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	fmt.Fprintf(w, "vfmpd_memory_alloc_bytes %d\n", stats.Memory.Alloc)
+	metric("vfmpd_memory_sys_bytes", "gauge", "Bytes of memory obtained from the system.")
+	fmt.Fprintf(w, "vfmpd_memory_sys_bytes %d\n", stats.Memory.Sys)
+	metric("vfmpd_gc_runs_total", "counter", "Garbage collections.")
+	fmt.Fprintf(w, "vfmpd_gc_runs_total %d\n", stats.Memory.NumGC)
+	metric("vfmpd_goroutines", "gauge", "Running goroutines.")
+	fmt.Fprintf(w, "vfmpd_goroutines %d\n", stats.Memory.Goroutines)
+
+	metric("vfmpd_index_size_bytes", "gauge", "Size of the index files.")
+	for _, index := range stats.Indexes {
+		fmt.Fprintf(w, "vfmpd_index_size_bytes{index=%q} %d\n", index.Name, index.Size)
+	}
+	metric("vfmpd_index_age_seconds", "gauge", "Time since the index files were written.")
+	for _, index := range stats.Indexes {
+		fmt.Fprintf(w, "vfmpd_index_age_seconds{index=%q} %g\n", index.Name, index.Age.Seconds())
+	}
+	metric("vfmpd_index_loaded", "gauge", "Whether the index is kept in memory between searches.")
+	for _, index := range stats.Indexes {
+		loaded := 0
+		if index.Loaded {
+			loaded = 1
+		}
+		fmt.Fprintf(w, "vfmpd_index_loaded{index=%q} %d\n", index.Name, loaded)
+	}
+	metric("vfmpd_index_entries", "gauge", "Nodes, names or files in the loaded indexes.")
+	for _, index := range stats.Indexes {
+		if index.Loaded {
+			fmt.Fprintf(w, "vfmpd_index_entries{index=%q} %d\n", index.Name, index.Entries)
+		}
+	}
+
+	jobs := make([]string, 0, len(stats.Jobs))
+	for name := range stats.Jobs {
+		jobs = append(jobs, name)
+	}
+	sort.Strings(jobs)
+	metric("vfmpd_jobs_total", "counter", "Finished requests and scheduled runs by type.")
+	for _, name := range jobs {
+		fmt.Fprintf(w, "vfmpd_jobs_total{job=%q} %d\n", name, stats.Jobs[name].Count)
+	}
+	metric("vfmpd_jobs_running", "gauge", "Running requests and scheduled runs by type.")
+	for _, name := range jobs {
+		fmt.Fprintf(w, "vfmpd_jobs_running{job=%q} %d\n", name, stats.Jobs[name].Running)
+	}
+	metric("vfmpd_job_duration_seconds_total", "counter", "Time spent on finished jobs by type.")
+	for _, name := range jobs {
+		fmt.Fprintf(w, "vfmpd_job_duration_seconds_total{job=%q} %g\n", name, stats.Jobs[name].TotalDuration.Seconds())
+	}
+	metric("vfmpd_job_last_duration_seconds", "gauge", "Time the last finished job of each type took.")
+	for _, name := range jobs {
+		fmt.Fprintf(w, "vfmpd_job_last_duration_seconds{job=%q} %g\n", name, stats.Jobs[name].LastDuration.Seconds())
+	}
+
+	modes := make([]string, 0, len(stats.Searches))
+	for mode := range stats.Searches {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	metric("vfmpd_search_duration_seconds", "histogram", "Time searches took by mode, without loading the index.")
+	for _, mode := range modes {
+		latency := stats.Searches[mode]
+		for _, bucket := range latency.Buckets {
+			fmt.Fprintf(w, "vfmpd_search_duration_seconds_bucket{mode=%q,le=\"%g\"} %d\n", mode, bucket.LE, bucket.Count)
+		}
+		fmt.Fprintf(w, "vfmpd_search_duration_seconds_bucket{mode=%q,le=\"+Inf\"} %d\n", mode, latency.Count)
+		fmt.Fprintf(w, "vfmpd_search_duration_seconds_sum{mode=%q} %g\n", mode, latency.Sum.Seconds())
+		fmt.Fprintf(w, "vfmpd_search_duration_seconds_count{mode=%q} %d\n", mode, latency.Count)
+	}
+}
+
+// startMetricsServer serves the stats in the Prometheus format on /metrics,
+// and /health, which fails once the daemon is stopping, until the daemon
+// stops.
+func startMetricsServer(cfg *ConfigDatabase) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, collectStats(runningConfig.Load()))
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown() {
+			http.Error(w, "stopping", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	listener, err := net.Listen("tcp", cfg.Metrics.Address)
+	if err != nil {
+		slog.Error("Unable to serve metrics", "addr", cfg.Metrics.Address, "err", err)
+		return
+	}
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-daemonState.stopping
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("Error serving metrics", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of file into memory. A writable mapping
+// can be changed, but whether the changes reach the file depends on the
+// platform, so they must only be read back from the mapping.
+func mapFile(file *os.File, size uint64, writable bool) ([]byte, error) {
+	if size > math.MaxInt {
+		return nil, fmt.Errorf("%s is too large to map", file.Name())
+	}
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(file.Fd()), 0, int(size), prot, syscall.MAP_SHARED)
+}
+
+// unmapFile releases a mapping made by mapFile.
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+)
+
+// mapFile reads the first size bytes of file into memory, Windows has no
+// mmap in the syscall package. Changes to the data never reach the file.
+func mapFile(file *os.File, size uint64, writable bool) ([]byte, error) {
+	if size > math.MaxInt {
+		return nil, fmt.Errorf("%s is too large to map", file.Name())
+	}
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// unmapFile releases data read by mapFile.
+func unmapFile(data []byte) error {
+	return nil
+}
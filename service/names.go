@@ -0,0 +1,308 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Search modes that are answered by the name index.
+const (
+	SearchPrefix   = "prefix"
+	SearchSuffix   = "suffix"
+	SearchContains = "contains"
+)
+
+// NameIndex is a secondary index over the base names of indexed files. It
+// answers prefix, suffix and substring queries without walking the trie.
+// Names are compared by their key, normalized with the same NameOptions as
+// exact search.
+type NameIndex struct {
+	Options NameOptions
+	// Unique name keys, sorted.
+	Keys []string
+	// Ids of Keys sorted by their reversed key, for suffix queries.
+	Suffixes []uint32
+	// Ids of the keys containing each trigram, sorted.
+	Trigrams map[string][]uint32
+	// Directories of the indexed files.
+	Dirs []string
+	// The files with each key.
+	Files [][]NameFile
+
+	// Built on the first typo search.
+	bkOnce sync.Once
+	bk     *bkTree
+}
+
+// NameFile is a file in the name index, with its name as originally spelled.
+type NameFile struct {
+	Dir  uint32
+	Name string
+}
+
+// NameIndexBuilder collects the base names found by walkFiles. Names are
+// spilled to disk in sorted runs while walking, like the paths of
+// StreamBuilder, so only the built index has to fit in memory.
+type NameIndexBuilder struct {
+	dir   string
+	opts  NameOptions
+	names *runSorter
+	err   error
+}
+
+// NewNameIndexBuilder creates a builder that keeps its temporary files in a
+// new directory inside dataDir and uses about budget bytes of memory while
+// walking.
+func NewNameIndexBuilder(dataDir string, budget int, opts NameOptions) (*NameIndexBuilder, error) {
+	dir, err := os.MkdirTemp(dataDir, "names-")
+	if err != nil {
+		return nil, err
+	}
+	return &NameIndexBuilder{
+		dir:   dir,
+		opts:  opts,
+		names: newRunSorter(dir, budget),
+	}, nil
+}
+
+// AddPath adds a file to the index. Errors are kept and reported by Build.
+func (b *NameIndexBuilder) AddPath(path string) {
+	if b.err != nil {
+		return
+	}
+	path = strings.ReplaceAll(path, "\\", "/")
+	i := strings.LastIndex(path, "/")
+	dir, name := path[:i+1], path[i+1:]
+	b.err = b.names.Add(encodeNameRecord(b.opts.Key(name), dir, name))
+}
+
+func (b *NameIndexBuilder) AddFile(path string, info os.FileInfo) {
+	b.AddPath(path)
+}
+
+// Abort removes the temporary files without building the index. It does
+// nothing once the index is built.
+func (b *NameIndexBuilder) Abort() {
+	if b.dir == "" {
+		return
+	}
+	os.RemoveAll(b.dir)
+	b.dir = ""
+}
+
+// Build merges the collected names in key order and builds the lookup
+// tables. The temporary files are removed whether it succeeds or not.
+func (b *NameIndexBuilder) Build() (*NameIndex, error) {
+	defer b.Abort()
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	idx := &NameIndex{Options: b.opts}
+	dirs := make(map[string]uint32)
+	last := ""
+	err := b.names.Merge(func(record string) error {
+		// The same path may have been added twice.
+		if record == last {
+			return nil
+		}
+		last = record
+		key, dir, name := decodeNameRecord(record)
+
+		id, ok := dirs[dir]
+		if !ok {
+			id = uint32(len(idx.Dirs))
+			dirs[dir] = id
+			idx.Dirs = append(idx.Dirs, dir)
+		}
+		if n := len(idx.Keys); n == 0 || idx.Keys[n-1] != key {
+			idx.Keys = append(idx.Keys, key)
+			idx.Files = append(idx.Files, nil)
+		}
+		n := len(idx.Files) - 1
+		idx.Files[n] = append(idx.Files[n], NameFile{Dir: id, Name: name})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	idx.Suffixes = make([]uint32, len(idx.Keys))
+	idx.Trigrams = make(map[string][]uint32)
+	reversed := make([]string, len(idx.Keys))
+	for i, key := range idx.Keys {
+		idx.Suffixes[i] = uint32(i)
+		reversed[i] = reverse(key)
+
+		seen := map[string]bool{}
+		for j := 0; j+3 <= len(key); j++ {
+			trigram := key[j : j+3]
+			if !seen[trigram] {
+				seen[trigram] = true
+				idx.Trigrams[trigram] = append(idx.Trigrams[trigram], uint32(i))
+			}
+		}
+	}
+	sort.Slice(idx.Suffixes, func(i, j int) bool {
+		return reversed[idx.Suffixes[i]] < reversed[idx.Suffixes[j]]
+	})
+	return idx, nil
+}
+
+// Name records hold the name key, the directory and the name, separated by
+// zero bytes, which names cannot contain. They sort by key first, and a key
+// sorts before the longer keys it is a prefix of, like the keys alone.
+func encodeNameRecord(key, dir, name string) string {
+	return key + "\x00" + dir + "\x00" + name
+}
+
+func decodeNameRecord(record string) (key, dir, name string) {
+	key, rest, _ := strings.Cut(record, "\x00")
+	dir, name, _ = strings.Cut(rest, "\x00")
+	return key, dir, name
+}
+
+// reverse reverses the bytes of s, so that suffixes can be found like prefixes.
+func reverse(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
+
+// Find returns the paths of files whose name matches query in the given mode.
+func (idx *NameIndex) Find(mode, query string, max int) []string {
+	query = idx.Options.Key(query)
+
+	var ids []uint32
+	switch mode {
+	case SearchPrefix:
+		first := sort.SearchStrings(idx.Keys, query)
+		for i := first; i < len(idx.Keys) && strings.HasPrefix(idx.Keys[i], query); i++ {
+			ids = append(ids, uint32(i))
+		}
+	case SearchSuffix:
+		reversed := reverse(query)
+		first := sort.Search(len(idx.Suffixes), func(i int) bool {
+			return reverse(idx.Keys[idx.Suffixes[i]]) >= reversed
+		})
+		for i := first; i < len(idx.Suffixes) && strings.HasSuffix(idx.Keys[idx.Suffixes[i]], query); i++ {
+			ids = append(ids, idx.Suffixes[i])
+		}
+	case SearchContains:
+		ids = idx.contains(query)
+	}
+
+	results := []string{}
+	for _, id := range ids {
+		for _, file := range idx.Files[id] {
+			if max > 0 && len(results) >= max {
+				return results
+			}
+			results = append(results, idx.Dirs[file.Dir]+file.Name)
+		}
+	}
+	return results
+}
+
+func (idx *NameIndex) contains(query string) []uint32 {
+	// Queries shorter than a trigram can only be checked against every name.
+	if len(query) < 3 {
+		var ids []uint32
+		for i, key := range idx.Keys {
+			if strings.Contains(key, query) {
+				ids = append(ids, uint32(i))
+			}
+		}
+		return ids
+	}
+
+	// Intersect the postings of every trigram in the query, starting with
+	// the shortest, then check the remaining candidates.
+	var postings [][]uint32
+	for j := 0; j+3 <= len(query); j++ {
+		list, ok := idx.Trigrams[query[j:j+3]]
+		if !ok {
+			return nil
+		}
+		postings = append(postings, list)
+	}
+	sort.Slice(postings, func(i, j int) bool { return len(postings[i]) < len(postings[j]) })
+
+	candidates := postings[0]
+	for _, list := range postings[1:] {
+		candidates = intersect(candidates, list)
+		if len(candidates) == 0 {
+			return nil
+		}
+	}
+
+	var ids []uint32
+	for _, id := range candidates {
+		if strings.Contains(idx.Keys[id], query) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// intersect returns the ids present in both sorted lists.
+func intersect(a, b []uint32) []uint32 {
+	var out []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+func (idx *NameIndex) SaveToFile(filename string) error {
+	tmpName := filename + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	gw := gzip.NewWriter(file)
+	err = gob.NewEncoder(gw).Encode(idx)
+	if closeErr := gw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+func (idx *NameIndex) LoadFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	return gob.NewDecoder(gr).Decode(idx)
+}
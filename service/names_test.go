@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// nameTestPaths are indexed by the name index tests.
+var nameTestPaths = []string{
+	"/src/app/main.go",
+	"/src/app/main_test.go",
+	"/src/app/README.md",
+	"/src/lib/domain.go",
+	"/docs/MAIN.go",
+	"/docs/readme.txt",
+	"/x/ab",
+}
+
+// nameTestIndex builds a name index of paths with the given memory budget.
+func nameTestIndex(t *testing.T, budget int, paths []string) *NameIndex {
+	t.Helper()
+	builder, err := NewNameIndexBuilder(t.TempDir(), budget, NameOptions{IgnoreCase: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		builder.AddPath(path)
+	}
+	idx, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestNameIndexFind(t *testing.T) {
+	tests := []struct {
+		mode  string
+		query string
+		want  []string
+	}{
+		{SearchPrefix, "main", []string{"/docs/MAIN.go", "/src/app/main.go", "/src/app/main_test.go"}},
+		{SearchPrefix, "MAIN.G", []string{"/docs/MAIN.go", "/src/app/main.go"}},
+		{SearchPrefix, "x", nil},
+		{SearchSuffix, ".go", []string{"/docs/MAIN.go", "/src/app/main.go", "/src/app/main_test.go", "/src/lib/domain.go"}},
+		{SearchSuffix, "_TEST.go", []string{"/src/app/main_test.go"}},
+		{SearchSuffix, "a_long_name_test.go", nil},
+		{SearchContains, "ain", []string{"/docs/MAIN.go", "/src/app/main.go", "/src/app/main_test.go", "/src/lib/domain.go"}},
+		{SearchContains, "main_t", []string{"/src/app/main_test.go"}},
+		{SearchContains, "E.M", []string{"/src/app/README.md"}},
+		{SearchContains, "mdx", nil},
+		{SearchContains, "domain_", nil},
+		{SearchContains, "ab", []string{"/x/ab"}},
+	}
+	// A budget of one byte spills every name to its own run.
+	for _, budget := range []int{1, 1 << 20} {
+		// Adding a file twice keeps one copy.
+		idx := nameTestIndex(t, budget, append(nameTestPaths, nameTestPaths[0]))
+
+		filename := filepath.Join(t.TempDir(), "names.gob")
+		if err := idx.SaveToFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		loaded := &NameIndex{}
+		if err := loaded.LoadFromFile(filename); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			got := loaded.Find(test.mode, test.query, 0)
+			sort.Strings(got)
+			if len(got) == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("budget %d: %s %q = %q, want %q", budget, test.mode, test.query, got, test.want)
+			}
+		}
+	}
+}
+
+func TestNameIndexFindMax(t *testing.T) {
+	idx := nameTestIndex(t, 1<<20, nameTestPaths)
+	if got := idx.Find(SearchSuffix, ".go", 2); len(got) != 2 {
+		t.Errorf("Find with max 2 = %q", got)
+	}
+	if got := idx.Find(SearchSuffix, ".go", 0); len(got) != 4 {
+		t.Errorf("Find with no max = %q", got)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Supported Unicode normalization forms.
+const (
+	NormalizeNone = "none"
+	NormalizeNFC  = "nfc"
+	NormalizeNFD  = "nfd"
+	NormalizeNFKC = "nfkc"
+	NormalizeNFKD = "nfkd"
+)
+
+// NameOptions controls how file names are compared by exact search. The same
+// options are used when an index is built and when it is queried, so they
+// are stored in the index itself.
+type NameOptions struct {
+	IgnoreCase    bool
+	Normalization string
+}
+
+func nameOptionsFromConfig(cfg *ConfigDatabase) NameOptions {
+	return NameOptions{
+		IgnoreCase:    cfg.Search.IgnoreCase,
+		Normalization: cfg.Search.Normalization,
+	}
+}
+
+func validNormalization(form string) error {
+	switch form {
+	case NormalizeNone, NormalizeNFC, NormalizeNFD, NormalizeNFKC, NormalizeNFKD:
+		return nil
+	}
+	return fmt.Errorf("unknown normalization form: %s", form)
+}
+
+// Key returns the form of name that is compared by exact search.
+func (o NameOptions) Key(name string) string {
+	switch o.Normalization {
+	case NormalizeNFC:
+		name = norm.NFC.String(name)
+	case NormalizeNFD:
+		name = norm.NFD.String(name)
+	case NormalizeNFKC:
+		name = norm.NFKC.String(name)
+	case NormalizeNFKD:
+		name = norm.NFKD.String(name)
+	}
+	if o.IgnoreCase {
+		// Folding can denormalize some strings, so normalize once more.
+		name = cases.Fold().String(name)
+		if o.Normalization != NormalizeNone && o.Normalization != "" {
+			return NameOptions{Normalization: o.Normalization}.Key(name)
+		}
+	}
+	return name
+}
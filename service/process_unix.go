@@ -0,0 +1,38 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processAlive reports whether a process with the PID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+	// The process exists but belongs to another user.
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// pidFileLocked reports whether a process holds the lock on the PID file,
+// which the daemon does for as long as it runs.
+func pidFileLocked(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	return errors.Is(err, syscall.EWOULDBLOCK)
+}
+
+// terminateProcess asks the process with the PID to stop.
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// killProcess stops the process with the PID right away.
+func killProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
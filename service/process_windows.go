@@ -0,0 +1,36 @@
+package main
+
+import "os"
+
+// processAlive reports whether a process with the PID exists.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// pidFileLocked reports whether a process holds the lock on the PID file.
+// vfmpd cannot run as a daemon on Windows, so there is never a daemon
+// holding it.
+func pidFileLocked(filename string) bool {
+	return false
+}
+
+// terminateProcess asks the process with the PID to stop. Windows has no
+// SIGTERM, so it is killed.
+func terminateProcess(pid int) error {
+	return killProcess(pid)
+}
+
+// killProcess stops the process with the PID right away.
+func killProcess(pid int) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer process.Release()
+	return process.Kill()
+}
@@ -0,0 +1,814 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SearchQuery evaluates a query like `ext:go -path:vendor modified:>7d`.
+const SearchQuery = "query"
+
+// QueryError is a syntax error in a query. Pos is the byte offset where the
+// problem was found.
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("position %d: %s", e.Pos, e.Msg)
+}
+
+// Query is a parsed query. Terms next to each other must all match, OR
+// matches either side, and NOT or a leading - negates a term. Parentheses
+// group terms. A term is a predicate like name:value, or a bare value which
+// is matched against the name.
+type Query struct {
+	expr queryExpr
+}
+
+// queryFile is a file being tested against a query.
+type queryFile struct {
+	path    string
+	name    string
+	modTime int64
+	size    int64
+	link    string
+}
+
+// dirMatch tells whether every file below a directory matches a query, none
+// of them do, or they have to be tested one by one.
+type dirMatch int
+
+const (
+	dirSome dirMatch = iota
+	dirAll
+	dirNone
+)
+
+// dirSummary describes the files below a directory, so that queries can
+// decide for the whole directory. Extensions and the bytes of name keys are
+// kept as bit sets of their hashes: a missing bit rules a value out, a set
+// bit proves nothing.
+type dirSummary struct {
+	minSize, maxSize       int64
+	minModTime, maxModTime int64
+	exts                   uint64
+	chars                  uint64
+}
+
+// newDirSummary returns the summary of a directory without files.
+func newDirSummary() dirSummary {
+	return dirSummary{
+		minSize:    math.MaxInt64,
+		maxSize:    math.MinInt64,
+		minModTime: math.MaxInt64,
+		maxModTime: math.MinInt64,
+	}
+}
+
+func (s *dirSummary) empty() bool {
+	return s.minSize > s.maxSize
+}
+
+// add adds a file with the name and its normalized key.
+func (s *dirSummary) add(name, key string, size, modTime int64) {
+	s.minSize = min(s.minSize, size)
+	s.maxSize = max(s.maxSize, size)
+	s.minModTime = min(s.minModTime, modTime)
+	s.maxModTime = max(s.maxModTime, modTime)
+	if ext := path.Ext(name); ext != "" {
+		s.exts |= extBit(ext[1:])
+	}
+	for i := 0; i < len(key); i++ {
+		s.chars |= charBit(key[i])
+	}
+}
+
+func (s *dirSummary) merge(o *dirSummary) {
+	s.minSize = min(s.minSize, o.minSize)
+	s.maxSize = max(s.maxSize, o.maxSize)
+	s.minModTime = min(s.minModTime, o.minModTime)
+	s.maxModTime = max(s.maxModTime, o.maxModTime)
+	s.exts |= o.exts
+	s.chars |= o.chars
+}
+
+// appendDirSummary appends s in the layout of the flat index.
+func appendDirSummary(b []byte, s *dirSummary) []byte {
+	for _, v := range []int64{s.minSize, s.maxSize, s.minModTime, s.maxModTime} {
+		b = binary.LittleEndian.AppendUint64(b, uint64(v))
+	}
+	b = binary.LittleEndian.AppendUint64(b, s.exts)
+	return binary.LittleEndian.AppendUint64(b, s.chars)
+}
+
+func decodeDirSummary(b []byte) *dirSummary {
+	return &dirSummary{
+		minSize:    int64(binary.LittleEndian.Uint64(b)),
+		maxSize:    int64(binary.LittleEndian.Uint64(b[8:])),
+		minModTime: int64(binary.LittleEndian.Uint64(b[16:])),
+		maxModTime: int64(binary.LittleEndian.Uint64(b[24:])),
+		exts:       binary.LittleEndian.Uint64(b[32:]),
+		chars:      binary.LittleEndian.Uint64(b[40:]),
+	}
+}
+
+// extBit returns the bit of an extension in dirSummary.exts. Extensions are
+// compared regardless of case, and only ASCII ones can be folded reliably,
+// so every other extension sets all bits.
+func extBit(ext string) uint64 {
+	h := uint32(2166136261)
+	for i := 0; i < len(ext); i++ {
+		c := ext[i]
+		if c >= utf8.RuneSelf {
+			return math.MaxUint64
+		}
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		h = (h ^ uint32(c)) * 16777619
+	}
+	return 1 << (h >> 26)
+}
+
+// charBit returns the bit of a byte in dirSummary.chars.
+func charBit(c byte) uint64 {
+	return 1 << (uint32(c) * 2654435769 >> 26)
+}
+
+type queryExpr interface {
+	// prepare normalizes the expression the same way as the index.
+	prepare(opts NameOptions)
+	match(f *queryFile) bool
+	// matchDir decides for all files below dir without looking at them, so
+	// whole subtrees can be skipped while walking the index. sum describes
+	// the files below dir, or is nil when the index has no summaries.
+	matchDir(dir string, sum *dirSummary) dirMatch
+}
+
+type andExpr struct{ left, right queryExpr }
+type orExpr struct{ left, right queryExpr }
+type notExpr struct{ expr queryExpr }
+
+func (e *andExpr) prepare(opts NameOptions) { e.left.prepare(opts); e.right.prepare(opts) }
+func (e *orExpr) prepare(opts NameOptions)  { e.left.prepare(opts); e.right.prepare(opts) }
+func (e *notExpr) prepare(opts NameOptions) { e.expr.prepare(opts) }
+
+func (e *andExpr) match(f *queryFile) bool { return e.left.match(f) && e.right.match(f) }
+func (e *orExpr) match(f *queryFile) bool  { return e.left.match(f) || e.right.match(f) }
+func (e *notExpr) match(f *queryFile) bool { return !e.expr.match(f) }
+
+func (e *andExpr) matchDir(dir string, sum *dirSummary) dirMatch {
+	left := e.left.matchDir(dir, sum)
+	if left == dirNone {
+		return dirNone
+	}
+	right := e.right.matchDir(dir, sum)
+	if right == dirNone || (left == dirAll && right == dirAll) {
+		return right
+	}
+	return dirSome
+}
+
+func (e *orExpr) matchDir(dir string, sum *dirSummary) dirMatch {
+	left := e.left.matchDir(dir, sum)
+	if left == dirAll {
+		return dirAll
+	}
+	right := e.right.matchDir(dir, sum)
+	if right == dirAll || (left == dirNone && right == dirNone) {
+		return right
+	}
+	return dirSome
+}
+
+func (e *notExpr) matchDir(dir string, sum *dirSummary) dirMatch {
+	switch e.expr.matchDir(dir, sum) {
+	case dirAll:
+		return dirNone
+	case dirNone:
+		return dirAll
+	}
+	return dirSome
+}
+
+// textPredicate matches a name or a whole path. Patterns with wildcards must
+// match completely, other patterns only have to be contained in the text.
+type textPredicate struct {
+	wholePath bool
+	pattern   string
+	glob      *regexp.Regexp
+	opts      NameOptions
+	// Bits of the bytes every matching name key contains
+	chars uint64
+}
+
+func (p *textPredicate) prepare(opts NameOptions) {
+	p.opts = opts
+	p.pattern = opts.Key(p.pattern)
+	if p.glob != nil {
+		// The pattern was checked when parsing, normalizing keeps it valid.
+		p.glob, _ = compileGlob(p.pattern)
+	}
+
+	p.chars = 0
+	for i := 0; i < len(p.pattern); i++ {
+		switch c := p.pattern[i]; {
+		case p.glob != nil && (c == '*' || c == '?'):
+		case p.glob != nil && c == '[':
+			i += strings.IndexByte(p.pattern[i:], ']')
+		default:
+			p.chars |= charBit(c)
+		}
+	}
+}
+
+func (p *textPredicate) test(text string) bool {
+	text = p.opts.Key(text)
+	if p.glob != nil {
+		return p.glob.MatchString(text)
+	}
+	return strings.Contains(text, p.pattern)
+}
+
+// compileGlob turns a pattern with *, ? and [...] wildcards into a regular
+// expression. Unlike path.Match, * also matches across separators, so
+// path:*/vendor/* finds files at any depth.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']' in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func (p *textPredicate) match(f *queryFile) bool {
+	if p.wholePath {
+		return p.test(f.path)
+	}
+	return p.test(f.name)
+}
+
+func (p *textPredicate) matchDir(dir string, sum *dirSummary) dirMatch {
+	if sum != nil && sum.empty() {
+		return dirNone
+	}
+	// Every path below a directory contains the directory's path.
+	if p.wholePath && p.glob == nil && p.test(dir) {
+		return dirAll
+	}
+	if !p.wholePath && sum != nil && p.chars&^sum.chars != 0 {
+		return dirNone
+	}
+	return dirSome
+}
+
+// extPredicate matches the file extension, regardless of case.
+type extPredicate struct {
+	ext string
+}
+
+func (p *extPredicate) prepare(NameOptions) {}
+
+func (p *extPredicate) match(f *queryFile) bool {
+	ext := path.Ext(f.name)
+	return ext != "" && strings.EqualFold(ext[1:], p.ext)
+}
+
+func (p *extPredicate) matchDir(dir string, sum *dirSummary) dirMatch {
+	if sum != nil && (sum.empty() || extBit(p.ext)&sum.exts == 0) {
+		return dirNone
+	}
+	return dirSome
+}
+
+// linkPredicate matches symbolic links recorded with their target, where
+// the target matches the pattern like a name does.
+type linkPredicate struct {
+	pattern string
+	glob    *regexp.Regexp
+}
+
+func (p *linkPredicate) prepare(NameOptions) {}
+
+func (p *linkPredicate) match(f *queryFile) bool {
+	if f.link == "" {
+		return false
+	}
+	if p.glob != nil {
+		return p.glob.MatchString(f.link)
+	}
+	return strings.Contains(f.link, p.pattern)
+}
+
+func (p *linkPredicate) matchDir(dir string, sum *dirSummary) dirMatch {
+	if sum != nil && sum.empty() {
+		return dirNone
+	}
+	return dirSome
+}
+
+// Comparison operators of size and time predicates.
+const (
+	compareEqual = iota
+	compareLess
+	compareLessEqual
+	compareGreater
+	compareGreaterEqual
+)
+
+func compare(op int, a, b int64) bool {
+	switch op {
+	case compareLess:
+		return a < b
+	case compareLessEqual:
+		return a <= b
+	case compareGreater:
+		return a > b
+	case compareGreaterEqual:
+		return a >= b
+	}
+	return a == b
+}
+
+// numberPredicate compares the size or the modification time of a file.
+type numberPredicate struct {
+	modTime bool
+	op      int
+	value   int64
+}
+
+func (p *numberPredicate) prepare(NameOptions) {}
+
+func (p *numberPredicate) match(f *queryFile) bool {
+	if p.modTime {
+		return compare(p.op, f.modTime, p.value)
+	}
+	return compare(p.op, f.size, p.value)
+}
+
+func (p *numberPredicate) matchDir(dir string, sum *dirSummary) dirMatch {
+	if sum == nil {
+		return dirSome
+	}
+	if sum.empty() {
+		return dirNone
+	}
+	low, high := sum.minSize, sum.maxSize
+	if p.modTime {
+		low, high = sum.minModTime, sum.maxModTime
+	}
+	// Every operator matches a range of values, so the files below match
+	// if both ends do. Only = can match in between ends that do not.
+	lowMatch, highMatch := compare(p.op, low, p.value), compare(p.op, high, p.value)
+	switch {
+	case lowMatch && highMatch:
+		return dirAll
+	case !lowMatch && !highMatch && (p.op != compareEqual || p.value < low || p.value > high):
+		return dirNone
+	}
+	return dirSome
+}
+
+// Kinds of query tokens.
+const (
+	tokenTerm = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+	tokenEnd
+)
+
+type queryToken struct {
+	kind  int
+	pos   int
+	field string
+	value string
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// lexQuery splits a query into tokens. Values may be quoted to include
+// spaces, parentheses or a leading minus.
+func lexQuery(query string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for {
+		for i < len(query) && isQuerySpace(query[i]) {
+			i++
+		}
+		if i == len(query) {
+			return append(tokens, queryToken{kind: tokenEnd, pos: i}), nil
+		}
+
+		start := i
+		switch query[i] {
+		case '(':
+			tokens = append(tokens, queryToken{kind: tokenOpen, pos: start})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, queryToken{kind: tokenClose, pos: start})
+			i++
+			continue
+		case '-':
+			tokens = append(tokens, queryToken{kind: tokenNot, pos: start})
+			i++
+			continue
+		}
+
+		var field, value strings.Builder
+		quoted := false
+		for i < len(query) && !isQuerySpace(query[i]) && query[i] != '(' && query[i] != ')' {
+			switch {
+			case query[i] == '"':
+				end := strings.IndexByte(query[i+1:], '"')
+				if end < 0 {
+					return nil, &QueryError{Pos: i, Msg: "missing closing quote"}
+				}
+				value.WriteString(query[i+1 : i+1+end])
+				i += end + 2
+				quoted = true
+			case query[i] == ':' && field.Len() == 0 && !quoted:
+				field.WriteString(value.String())
+				value.Reset()
+				i++
+				if field.Len() == 0 {
+					return nil, &QueryError{Pos: start, Msg: "missing field name before ':'"}
+				}
+			default:
+				value.WriteByte(query[i])
+				i++
+			}
+		}
+
+		token := queryToken{kind: tokenTerm, pos: start, field: strings.ToLower(field.String()), value: value.String()}
+		if field.Len() == 0 && !quoted {
+			switch token.value {
+			case "AND":
+				token.kind = tokenAnd
+			case "OR":
+				token.kind = tokenOr
+			case "NOT":
+				token.kind = tokenNot
+			}
+		}
+		if token.kind == tokenTerm && token.value == "" {
+			if token.field == "" {
+				return nil, &QueryError{Pos: start, Msg: "empty term"}
+			}
+			return nil, &QueryError{Pos: start, Msg: "missing value for " + token.field}
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	now    time.Time
+}
+
+// ParseQuery parses a query. Relative times like modified:>7d are counted
+// back from now.
+func ParseQuery(query string, now time.Time) (*Query, error) {
+	tokens, err := lexQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens, now: now}
+	if p.peek().kind == tokenEnd {
+		return nil, &QueryError{Pos: 0, Msg: "empty query"}
+	}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, &QueryError{Pos: t.pos, Msg: "unexpected ')'"}
+	}
+	return &Query{expr: expr}, nil
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) parseOr() (queryExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.next()
+		case tokenTerm, tokenNot, tokenOpen:
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+}
+
+func (p *queryParser) parseUnary() (queryExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNot:
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr}, nil
+	case tokenOpen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokenClose {
+			return nil, &QueryError{Pos: c.pos, Msg: "missing ')'"}
+		}
+		return expr, nil
+	case tokenTerm:
+		return p.parsePredicate(t)
+	case tokenEnd:
+		return nil, &QueryError{Pos: t.pos, Msg: "unexpected end of query"}
+	}
+	return nil, &QueryError{Pos: t.pos, Msg: "expected a term"}
+}
+
+func (p *queryParser) parsePredicate(t queryToken) (queryExpr, error) {
+	switch t.field {
+	case "", "name", "path":
+		pred := &textPredicate{wholePath: t.field == "path", pattern: t.value}
+		if strings.ContainsAny(t.value, "*?[") {
+			glob, err := compileGlob(t.value)
+			if err != nil {
+				return nil, &QueryError{Pos: t.pos, Msg: err.Error()}
+			}
+			pred.glob = glob
+		}
+		return pred, nil
+	case "ext":
+		return &extPredicate{ext: strings.TrimPrefix(t.value, ".")}, nil
+	case "link":
+		pred := &linkPredicate{pattern: t.value}
+		if strings.ContainsAny(t.value, "*?[") {
+			glob, err := compileGlob(t.value)
+			if err != nil {
+				return nil, &QueryError{Pos: t.pos, Msg: err.Error()}
+			}
+			pred.glob = glob
+		}
+		return pred, nil
+	case "size":
+		op, value := parseComparison(t.value)
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, &QueryError{Pos: t.pos, Msg: err.Error()}
+		}
+		return &numberPredicate{op: op, value: size}, nil
+	case "modified":
+		op, value := parseComparison(t.value)
+		when, span, err := parseTime(value, p.now)
+		if err != nil {
+			return nil, &QueryError{Pos: t.pos, Msg: err.Error()}
+		}
+		if op == compareEqual {
+			// modified:7d means within the last 7 days, and a date means
+			// any time on that day.
+			if span == 0 {
+				op = compareGreaterEqual
+			} else {
+				return &andExpr{
+					&numberPredicate{modTime: true, op: compareGreaterEqual, value: when.Unix()},
+					&numberPredicate{modTime: true, op: compareLess, value: when.Add(span).Unix()},
+				}, nil
+			}
+		}
+		// A date lasts until the end of its span, so modified:>2024-01-31
+		// starts on the next day and modified:<=2024-01-31 includes the
+		// whole day.
+		if span > 0 {
+			switch op {
+			case compareGreater:
+				op, when = compareGreaterEqual, when.Add(span)
+			case compareLessEqual:
+				op, when = compareLess, when.Add(span)
+			}
+		}
+		return &numberPredicate{modTime: true, op: op, value: when.Unix()}, nil
+	}
+	return nil, &QueryError{Pos: t.pos, Msg: "unknown field " + t.field}
+}
+
+// parseComparison splits the operator off a size or time value.
+func parseComparison(value string) (int, string) {
+	for _, op := range []struct {
+		prefix string
+		op     int
+	}{
+		{">=", compareGreaterEqual},
+		{"<=", compareLessEqual},
+		{">", compareGreater},
+		{"<", compareLess},
+		{"=", compareEqual},
+	} {
+		if strings.HasPrefix(value, op.prefix) {
+			return op.op, value[len(op.prefix):]
+		}
+	}
+	return compareEqual, value
+}
+
+// parseSize parses a size like 1.5M, with binary units.
+func parseSize(value string) (int64, error) {
+	units := map[string]float64{
+		"": 1, "b": 1,
+		"k": 1 << 10, "kb": 1 << 10,
+		"m": 1 << 20, "mb": 1 << 20,
+		"g": 1 << 30, "gb": 1 << 30,
+		"t": 1 << 40, "tb": 1 << 40,
+	}
+	end := strings.IndexFunc(value, func(r rune) bool { return r != '.' && !unicode.IsDigit(r) })
+	if end < 0 {
+		end = len(value)
+	}
+	number, err := strconv.ParseFloat(value[:end], 64)
+	unit, ok := units[strings.ToLower(value[end:])]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(number * unit), nil
+}
+
+// parseTime parses a date, a date and time, or a duration like 7d which is
+// counted back from now. span is how long the given date or time lasts, and
+// 0 for durations.
+func parseTime(value string, now time.Time) (when time.Time, span time.Duration, err error) {
+	for _, layout := range []struct {
+		layout string
+		span   time.Duration
+	}{
+		{"2006-01-02", 24 * time.Hour},
+		{"2006-01-02T15:04", time.Minute},
+		{time.RFC3339, time.Second},
+	} {
+		if t, err := time.ParseInLocation(layout.layout, value, time.Local); err == nil {
+			return t, layout.span, nil
+		}
+	}
+
+	units := map[string]time.Duration{
+		"s": time.Second,
+		"m": time.Minute,
+		"h": time.Hour,
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+	if len(value) > 1 {
+		number, err := strconv.Atoi(value[:len(value)-1])
+		if unit, ok := units[value[len(value)-1:]]; ok && err == nil {
+			return now.Add(-time.Duration(number) * unit), 0, nil
+		}
+	}
+	return time.Time{}, 0, fmt.Errorf("invalid time %q", value)
+}
+
+func (t *HybridTrie) Query(q *Query, max int) []string {
+	q.expr.prepare(t.nameOptions())
+	results := []string{}
+	t.queryHelper(t.root(), "", q, false, max, &results)
+	return results
+}
+
+// queryHelper collects the files below node that match q. When all is set,
+// every file below node is known to match.
+func (t *HybridTrie) queryHelper(node *TrieNode, prefix string, q *Query, all bool, max int, results *[]string) {
+	for key, child := range node.Children {
+		if max > 0 && len(*results) >= max {
+			return
+		}
+		newPath := prefix + child.label(key)
+		if child.IsEndOfWord {
+			f := queryFile{path: newPath, name: child.lastSegment(key), modTime: child.ModTime, size: child.Size, link: child.Link}
+			if all || q.expr.match(&f) {
+				*results = append(*results, newPath)
+			}
+		}
+		if len(child.Children) == 0 {
+			continue
+		}
+		childAll := all
+		if !all {
+			// The trie has no summaries, it is walked once per load anyway.
+			switch q.expr.matchDir(newPath, nil) {
+			case dirNone:
+				continue
+			case dirAll:
+				childAll = true
+			}
+		}
+		t.queryHelper(child, newPath+"/", q, childAll, max, results)
+	}
+}
+
+func (f *FlatIndex) Query(q *Query, max int) []string {
+	q.expr.prepare(f.opts)
+	results := []string{}
+	f.queryHelper(f.root, "", q, false, max, &results)
+	return results
+}
+
+func (f *FlatIndex) queryHelper(id uint32, prefix string, q *Query, all bool, max int, results *[]string) {
+	first := f.nodeField(id, flatNodeFirstChild)
+	count := f.nodeField(id, flatNodeChildCount)
+	for c := first; c < first+count; c++ {
+		if max > 0 && len(*results) >= max {
+			return
+		}
+		name := string(f.label(f.nodeField(c, flatNodeLabel)))
+		newPath := prefix + name
+		if f.nodeField(c, flatNodeFlags)&flatFlagEndOfWord != 0 {
+			file := queryFile{path: newPath, name: name, modTime: f.nodeModTime(c), size: f.nodeFileSize(c), link: f.nodeLink(c)}
+			if all || q.expr.match(&file) {
+				*results = append(*results, newPath)
+			}
+		}
+		if f.nodeField(c, flatNodeChildCount) == 0 {
+			continue
+		}
+		childAll := all
+		if !all {
+			switch q.expr.matchDir(newPath, f.dirSummary(c)) {
+			case dirNone:
+				continue
+			case dirAll:
+				childAll = true
+			}
+		}
+		f.queryHelper(c, newPath+"/", q, childAll, max, results)
+	}
+}
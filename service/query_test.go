@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testFileInfo is the metadata of a file that is not on disk.
+type testFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i testFileInfo) Name() string       { return i.name }
+func (i testFileInfo) Size() int64        { return i.size }
+func (i testFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (i testFileInfo) ModTime() time.Time { return i.modTime }
+func (i testFileInfo) IsDir() bool        { return false }
+func (i testFileInfo) Sys() interface{}   { return nil }
+
+func TestLexQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []queryToken
+	}{
+		{"main.go", []queryToken{
+			{kind: tokenTerm, pos: 0, value: "main.go"},
+			{kind: tokenEnd, pos: 7},
+		}},
+		{`-Ext:go OR name:"my file"`, []queryToken{
+			{kind: tokenNot, pos: 0},
+			{kind: tokenTerm, pos: 1, field: "ext", value: "go"},
+			{kind: tokenOr, pos: 8, value: "OR"},
+			{kind: tokenTerm, pos: 11, field: "name", value: "my file"},
+			{kind: tokenEnd, pos: 25},
+		}},
+		{`(a AND b) NOT "OR"`, []queryToken{
+			{kind: tokenOpen, pos: 0},
+			{kind: tokenTerm, pos: 1, value: "a"},
+			{kind: tokenAnd, pos: 3, value: "AND"},
+			{kind: tokenTerm, pos: 7, value: "b"},
+			{kind: tokenClose, pos: 8},
+			{kind: tokenNot, pos: 10, value: "NOT"},
+			{kind: tokenTerm, pos: 14, value: "OR"},
+			{kind: tokenEnd, pos: 18},
+		}},
+		{"size:>=1M", []queryToken{
+			{kind: tokenTerm, pos: 0, field: "size", value: ">=1M"},
+			{kind: tokenEnd, pos: 9},
+		}},
+	}
+	for _, test := range tests {
+		got, err := lexQuery(test.query)
+		if err != nil {
+			t.Errorf("lexQuery(%q): %v", test.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("lexQuery(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+	}{
+		{"", 0},
+		{"(ext:go", 7},
+		{"ext:go)", 6},
+		{"size:>abc", 0},
+		{"foo:bar", 0},
+		{`name:"x`, 5},
+		{"ext:go modified:>7q", 7},
+		{"OR", 0},
+		{"name:", 0},
+		{":go", 0},
+		{"ext:go -", 8},
+		{"name:[ab", 0},
+	}
+	for _, test := range tests {
+		_, err := ParseQuery(test.query, time.Now())
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) {
+			t.Errorf("ParseQuery(%q) = %v, want a QueryError", test.query, err)
+			continue
+		}
+		if queryErr.Pos != test.pos {
+			t.Errorf("ParseQuery(%q) error at %d, want %d: %v", test.query, queryErr.Pos, test.pos, err)
+		}
+	}
+}
+
+// queryTestFiles are indexed by TestQuery.
+var queryTestFiles = []testFileInfo{
+	{name: "/src/app/main.go", size: 2 << 10, modTime: time.Date(2024, 1, 30, 12, 0, 0, 0, time.Local)},
+	{name: "/src/app/main_test.go", size: 5 << 10, modTime: time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)},
+	{name: "/src/app/README.md", size: 300, modTime: time.Date(2024, 1, 31, 23, 59, 59, 0, time.Local)},
+	{name: "/src/vendor/lib/lib.go", size: 40 << 10, modTime: time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)},
+	{name: "/src/vendor/lib/LICENSE", size: 1 << 10, modTime: time.Date(2023, 6, 1, 0, 0, 0, 0, time.Local)},
+	{name: "/docs/Guide.MD", size: 3 << 20, modTime: time.Date(2024, 2, 10, 8, 0, 0, 0, time.Local)},
+	{name: "/docs/my notes.txt", size: 0, modTime: time.Date(2024, 2, 12, 8, 0, 0, 0, time.Local)},
+}
+
+// queryTestIndexes returns the files of queryTestFiles in a trie, in a flat
+// index written from the trie and in one written by StreamBuilder.
+func queryTestIndexes(t *testing.T) map[string]interface {
+	Query(q *Query, max int) []string
+} {
+	dir := t.TempDir()
+	opts := NameOptions{IgnoreCase: true, Normalization: NormalizeNFC}
+	trie := NewHybridTrie(opts)
+	builder, err := NewStreamBuilder(dir, 1<<20, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range queryTestFiles {
+		trie.AddFile(info.name, info)
+		builder.AddFile(info.name, info)
+	}
+
+	flatFile := filepath.Join(dir, "trie.idx")
+	if err := trie.SaveToFile(flatFile, FormatFlat); err != nil {
+		t.Fatal(err)
+	}
+	flat, err := OpenFlatIndex(flatFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flat.Close() })
+
+	streamFile := filepath.Join(dir, "stream.idx")
+	if err := builder.Finish(streamFile); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := OpenFlatIndex(streamFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+
+	return map[string]interface {
+		Query(q *Query, max int) []string
+	}{"trie": trie, "flat": flat, "stream": stream}
+}
+
+func TestQuery(t *testing.T) {
+	now := time.Date(2024, 2, 12, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"main", []string{"/src/app/main.go", "/src/app/main_test.go"}},
+		{"ext:go -path:vendor", []string{"/src/app/main.go", "/src/app/main_test.go"}},
+		{"ext:md", []string{"/docs/Guide.MD", "/src/app/README.md"}},
+		{"ext:rs", nil},
+		{"name:*_test.go OR name:lic*", []string{"/src/app/main_test.go", "/src/vendor/lib/LICENSE"}},
+		{"path:*/lib/*", []string{"/src/vendor/lib/LICENSE", "/src/vendor/lib/lib.go"}},
+		{`name:"my notes"`, []string{"/docs/my notes.txt"}},
+		{"zzz", nil},
+		{"size:>1M", []string{"/docs/Guide.MD"}},
+		{"size:<=1k", []string{"/docs/my notes.txt", "/src/app/README.md", "/src/vendor/lib/LICENSE"}},
+		{"size:=0", []string{"/docs/my notes.txt"}},
+		{"NOT size:<1M", []string{"/docs/Guide.MD"}},
+		{"(ext:go OR ext:md) size:>4k", []string{"/docs/Guide.MD", "/src/app/main_test.go", "/src/vendor/lib/lib.go"}},
+		{"modified:2024-01-31", []string{"/src/app/README.md", "/src/app/main_test.go"}},
+		{"modified:>2024-01-31", []string{"/docs/Guide.MD", "/docs/my notes.txt", "/src/vendor/lib/lib.go"}},
+		{"modified:>=2024-01-31", []string{"/docs/Guide.MD", "/docs/my notes.txt", "/src/app/README.md", "/src/app/main_test.go", "/src/vendor/lib/lib.go"}},
+		{"modified:<2024-01-31", []string{"/src/app/main.go", "/src/vendor/lib/LICENSE"}},
+		{"modified:<=2024-01-31", []string{"/src/app/README.md", "/src/app/main.go", "/src/app/main_test.go", "/src/vendor/lib/LICENSE"}},
+		{"modified:>3d", []string{"/docs/Guide.MD", "/docs/my notes.txt"}},
+		{"modified:<2y -path:src", nil},
+	}
+	for name, index := range queryTestIndexes(t) {
+		for _, test := range tests {
+			// Queries are prepared for the index they run on, so every
+			// index gets its own.
+			q, err := ParseQuery(test.query, now)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q): %v", test.query, err)
+			}
+			got := index.Query(q, 0)
+			sort.Strings(got)
+			if len(got) == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: %q = %q, want %q", name, test.query, got, test.want)
+			}
+		}
+	}
+}
+
+func TestQueryMatchDir(t *testing.T) {
+	now := time.Date(2024, 2, 12, 12, 0, 0, 0, time.Local)
+	opts := NameOptions{IgnoreCase: true}
+	sum := newDirSummary()
+	for _, info := range queryTestFiles[:3] {
+		name := path.Base(info.name)
+		sum.add(name, opts.Key(name), info.size, info.modTime.Unix())
+	}
+	empty := newDirSummary()
+
+	tests := []struct {
+		query string
+		sum   *dirSummary
+		want  dirMatch
+	}{
+		{"size:<1M", &sum, dirAll},
+		{"size:>1M", &sum, dirNone},
+		{"size:>1k", &sum, dirSome},
+		{"size:=10k", &sum, dirNone},
+		{"size:=2k", &sum, dirSome},
+		{"-size:>1M", &sum, dirAll},
+		{"modified:<2024-02-01", &sum, dirAll},
+		{"modified:>2024-01-31", &sum, dirNone},
+		{"ext:GO", &sum, dirSome},
+		{"ext:txt", &sum, dirNone},
+		{"name:zzz", &sum, dirNone},
+		{"name:*_TEST*", &sum, dirSome},
+		{"path:/src/app", &sum, dirAll},
+		{"ext:txt OR size:<1M", &sum, dirAll},
+		{"ext:go size:>1M", &sum, dirNone},
+		{"size:<1M", nil, dirSome},
+		{"main", &empty, dirNone},
+	}
+	for _, test := range tests {
+		q, err := ParseQuery(test.query, now)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %v", test.query, err)
+		}
+		q.expr.prepare(opts)
+		if got := q.expr.matchDir("/src/app", test.sum); got != test.want {
+			t.Errorf("%q: matchDir = %d, want %d", test.query, got, test.want)
+		}
+	}
+}
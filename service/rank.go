@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sahilm/fuzzy"
+)
+
+// RankWeights scale the parts of a fuzzy search score.
+type RankWeights struct {
+	// The fuzzy score of the whole path.
+	Fuzzy float64
+	// The fuzzy score of the file name alone, when the query matches it.
+	BaseName float64
+	// Subtracted for every directory the file is nested in.
+	Depth float64
+	// Added in full for files modified just now, halving every HalfLife.
+	Recency  float64
+	HalfLife time.Duration
+	// Added for the first time a file was opened, and again every time the
+	// number of opens doubles.
+	History float64
+}
+
+func rankWeightsFromConfig(cfg *ConfigDatabase) RankWeights {
+	return RankWeights{
+		Fuzzy:    cfg.Ranking.Fuzzy,
+		BaseName: cfg.Ranking.BaseName,
+		Depth:    cfg.Ranking.Depth,
+		Recency:  cfg.Ranking.Recency,
+		HalfLife: time.Duration(cfg.Ranking.HalfLife) * 24 * time.Hour,
+		History:  cfg.Ranking.History,
+	}
+}
+
+// ScoreBreakdown holds the weighted parts that add up to a match's score.
+type ScoreBreakdown struct {
+	Fuzzy    float64
+	BaseName float64
+	Depth    float64
+	Recency  float64
+	History  float64
+}
+
+func (b ScoreBreakdown) total() float64 {
+	return b.Fuzzy + b.BaseName + b.Depth + b.Recency + b.History
+}
+
+// Ranker orders fuzzy search results.
+type Ranker struct {
+	Weights RankWeights
+	// How many times each path was opened.
+	Opened map[string]int
+	Now    time.Time
+}
+
+// rankCandidate is a file considered by fuzzy search.
+type rankCandidate struct {
+	Path    string
+	ModTime int64
+}
+
+// candidatePaths lets fuzzy.FindFrom match candidates without copying their paths.
+type candidatePaths []rankCandidate
+
+func (c candidatePaths) String(i int) string { return c[i].Path }
+func (c candidatePaths) Len() int            { return len(c) }
+
+// Rank returns the candidates matching query, best first.
+func (r *Ranker) Rank(query string, candidates []rankCandidate) []Match {
+	matches := fuzzy.FindFrom(query, candidatePaths(candidates))
+	results := make([]Match, len(matches))
+	for i, match := range matches {
+		results[i] = r.score(query, match, candidates[match.Index])
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Score > results[j].Score
+	})
+	return results
+}
+
+func (r *Ranker) score(query string, match fuzzy.Match, file rankCandidate) Match {
+	w := r.Weights
+	result := Match{
+		Path:    match.Str,
+		Indexes: match.MatchedIndexes,
+	}
+	b := &result.Breakdown
+	b.Fuzzy = w.Fuzzy * float64(match.Score)
+
+	// Matching the query against the name alone keeps directories from
+	// drowning out a good name match. Highlight the name when it matches.
+	dir := strings.LastIndex(file.Path, "/") + 1
+	if names := fuzzy.Find(query, []string{file.Path[dir:]}); len(names) > 0 {
+		b.BaseName = w.BaseName * float64(names[0].Score)
+		result.Indexes = names[0].MatchedIndexes
+		for i := range result.Indexes {
+			result.Indexes[i] += dir
+		}
+	}
+
+	depth := strings.Count(strings.TrimPrefix(file.Path, "/"), "/")
+	b.Depth = -w.Depth * float64(depth)
+
+	if file.ModTime > 0 && w.HalfLife > 0 {
+		age := r.Now.Sub(time.Unix(file.ModTime, 0))
+		if age < 0 {
+			age = 0
+		}
+		b.Recency = w.Recency * math.Exp2(-float64(age)/float64(w.HalfLife))
+	}
+
+	if opened := r.Opened[file.Path]; opened > 0 {
+		b.History = w.History * math.Log2(1+float64(opened))
+	}
+
+	result.Score = b.total()
+	return result
+}
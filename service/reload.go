@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	sddaemon "github.com/coreos/go-systemd/v22/daemon"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v2"
+)
+
+// runningConfig is the config of the running daemon. A reload publishes a new
+// config instead of changing this one, so every request and job loads it
+// once and keeps using that snapshot until it is done.
+var runningConfig atomic.Pointer[ConfigDatabase]
+
+// configSettleTime is how long the config file has to stay unchanged before
+// it is reloaded, since editors often write a file in several steps.
+const configSettleTime = 500 * time.Millisecond
+
+// restartSettings are the settings that only change when vfmpd is
+// restarted. A reload keeps their running values.
+var restartSettings = map[string]bool{
+	"server.port":     true,
+	"data.dir":        true,
+	"log.format":      true,
+	"metrics.enabled": true,
+	"metrics.address": true,
+}
+
+// reindexSettings are the settings that change what the index holds or how
+// it is stored. When one of them changes, every root is indexed again, since
+// the saved index does not fit the new settings.
+var reindexSettings = map[string]bool{
+	"index.format":         true,
+	"search.ignore_case":   true,
+	"search.normalization": true,
+	"content.enabled":      true,
+}
+
+// ConfigReload tells what reloading the config changed, as sent to clients.
+type ConfigReload struct {
+	// Keys of the settings that were applied, like "log.level"
+	Applied []string
+	// Keys of the settings that changed but only apply once vfmpd is
+	// restarted
+	Restart []string
+	// Whether every root is being indexed again for the applied settings
+	Reindex bool
+}
+
+// ConfigInfo is the running config of the daemon, as sent to clients.
+type ConfigInfo struct {
+	File string
+	// In the format of the config file
+	Config string
+}
+
+// reloadConfig reads the config file again and publishes it as the running
+// config. Settings listed in restartSettings keep their running values.
+func reloadConfig() (ConfigReload, error) {
+	daemonState.reload.Lock()
+	defer daemonState.reload.Unlock()
+	reload := ConfigReload{Applied: []string{}, Restart: []string{}}
+	if shuttingDown() {
+		return reload, errShuttingDown
+	}
+
+	slog.Info("Reloading config", "file", configPath)
+	sddaemon.SdNotify(false, sddaemon.SdNotifyReloading)
+	defer sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
+
+	cfg := runningConfig.Load()
+	var newCfg ConfigDatabase
+	if err := readConfig(configPath, &newCfg); err != nil {
+		return reload, err
+	}
+	for _, key := range configChanges(cfg, &newCfg) {
+		if restartSettings[key] {
+			configField(&newCfg, key).Set(configField(cfg, key))
+			reload.Restart = append(reload.Restart, key)
+		} else {
+			reload.Applied = append(reload.Applied, key)
+			reload.Reindex = reload.Reindex || reindexSettings[key]
+		}
+	}
+	if len(reload.Restart) > 0 {
+		slog.Warn("Some settings change when vfmpd is restarted", "settings", reload.Restart)
+	}
+	if len(reload.Applied) == 0 {
+		slog.Info("No settings to apply")
+		return reload, nil
+	}
+	reindex := changedRoots(cfg.Roots, newCfg.Roots)
+
+	// Requests and jobs that already started keep the config they loaded.
+	// Scheduled runs are jobs too, so they finish in the background and
+	// shutdown still waits for them.
+	if scheduler := indexScheduler.Load(); scheduler != nil {
+		scheduler.Halt()
+	}
+	cfg = &newCfg
+	runningConfig.Store(cfg)
+	reloadLogging(cfg)
+
+	if err := startScheduler(cfg); err != nil {
+		return reload, err
+	}
+	fullReindex := reload.Reindex
+	goJob(func() {
+		logger := jobLog(slog.Default(), "roots")
+		if fullReindex {
+			logger.Info("Indexing every root again with the new settings")
+			if err := indexRoots(cfg.Roots, cfg, logger, nil); err != nil {
+				logger.Error("Error indexing roots", "err", err)
+			}
+			return
+		}
+		ensureRoots(cfg, logger)
+		for _, root := range reindex {
+			logger.Info("Indexing root again with its new options", "root", root.Path)
+			if err := indexRoot(root, cfg, logger, nil); err != nil {
+				logger.Error("Error indexing root", "root", root.Path, "err", err)
+			}
+		}
+	})
+	slog.Info("Config reloaded", "settings", reload.Applied)
+	return reload, nil
+}
+
+// configChanges returns the keys of the settings that differ between old
+// and new. The roots are compared as a whole.
+func configChanges(old, new *ConfigDatabase) []string {
+	var changes []string
+	var compare func(a, b reflect.Value, path string)
+	compare = func(a, b reflect.Value, path string) {
+		t := a.Type()
+		for i := 0; i < a.NumField(); i++ {
+			key := path + yamlKey(t.Field(i))
+			if a.Field(i).Kind() == reflect.Struct {
+				compare(a.Field(i), b.Field(i), key+".")
+			} else if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+				changes = append(changes, key)
+			}
+		}
+	}
+	compare(reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem(), "")
+	return changes
+}
+
+// configField returns the field of cfg with the key, like "server.port".
+func configField(cfg *ConfigDatabase, key string) reflect.Value {
+	v := reflect.ValueOf(cfg).Elem()
+	for _, name := range strings.Split(key, ".") {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if yamlKey(t.Field(i)) == name {
+				v = v.Field(i)
+				break
+			}
+		}
+	}
+	return v
+}
+
+// changedRoots returns the roots of new that are also in old but are walked
+// differently now, like with other excludes, so that they are indexed
+// again. A new schedule does not change what is indexed.
+func changedRoots(old, new []Root) []Root {
+	var changed []Root
+	for _, root := range new {
+		for _, before := range old {
+			if before.Path != root.Path {
+				continue
+			}
+			before.Schedule = root.Schedule
+			if !reflect.DeepEqual(before, root) {
+				changed = append(changed, root)
+			}
+		}
+	}
+	return changed
+}
+
+// watchConfig reloads the config whenever the config file changes, until
+// the daemon stops. The directory is watched rather than the file, so that
+// files replaced by editors are seen too.
+func watchConfig() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Unable to watch the config file", "err", err)
+		return
+	}
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		slog.Error("Unable to watch the config file", "file", configPath, "err", err)
+		watcher.Close()
+		return
+	}
+	slog.Debug("Watching the config file", "file", configPath)
+
+	go func() {
+		defer watcher.Close()
+		settle := time.NewTimer(0)
+		<-settle.C
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != configPath || event.Op == fsnotify.Chmod {
+					continue
+				}
+				settle.Reset(configSettleTime)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Error watching the config file", "err", err)
+			case <-settle.C:
+				if _, err := reloadConfig(); err != nil {
+					slog.Error("Unable to reload config", "err", err)
+				}
+			case <-daemonState.stopping:
+				return
+			}
+		}
+	}()
+}
+
+func processConfigGet(conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Config")
+
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		connLog(conn).Error("Error marshaling config", "err", err)
+		return
+	}
+	sendJSON(conn, "config", ConfigInfo{File: configPath, Config: string(data)})
+}
+
+func processConfigReload(conn net.Conn) {
+	connLog(conn).Info("Config reload")
+
+	reload, err := reloadConfig()
+	if err != nil {
+		connLog(conn).Error("Unable to reload config", "err", err)
+		sendJSON(conn, "config.reload.error", err.Error())
+		return
+	}
+	sendJSON(conn, "config.reload.done", reload)
+}
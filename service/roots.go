@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What the walker does with symbolic links.
+const (
+	// Symbolic links are left out of the index.
+	SymlinksIgnore = "ignore"
+	// Symbolic links are indexed as links, with their target.
+	SymlinksRecord = "record"
+	// Symbolic links are indexed like the file or directory they point to.
+	// Links back into a directory being walked are skipped.
+	SymlinksFollow = "follow"
+)
+
+// Root is a directory that the daemon keeps indexed.
+type Root struct {
+	Path string `yaml:"path"`
+	// Names to leave out, like "node_modules" or "*.tmp". Patterns with a
+	// slash are matched against the path relative to the root instead.
+	Exclude []string `yaml:"exclude"`
+	// How many directories deep to index, 0 for no limit
+	MaxDepth int    `yaml:"max_depth"`
+	Symlinks string `yaml:"symlinks" default:"record"`
+	// Do not go into directories on other file systems, like mount points
+	OneFilesystem bool `yaml:"one_filesystem"`
+	// When to index again, see the scheduler
+	Schedule string `yaml:"schedule" default:"off"`
+}
+
+// excluded reports whether the file at path, below the root, is left out.
+func (r Root) excluded(path string) bool {
+	rel, err := filepath.Rel(r.Path, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	name := filepath.Base(path)
+	for _, pattern := range r.Exclude {
+		target := name
+		if strings.Contains(pattern, "/") {
+			target = rel
+		}
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// depth returns how many directories below the root path is, with the files
+// directly in the root at depth 1.
+func (r Root) depth(path string) int {
+	rel, err := filepath.Rel(r.Path, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(filepath.ToSlash(rel), "/") + 1
+}
+
+// validRoots checks the configured roots and reports every problem found.
+func validRoots(roots []Root) error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, root := range roots {
+		if !filepath.IsAbs(root.Path) {
+			errs = append(errs, fmt.Errorf("roots[%d]: path %q is not absolute", i, root.Path))
+		}
+		if seen[root.Path] {
+			errs = append(errs, fmt.Errorf("roots[%d]: %s is listed twice", i, root.Path))
+		}
+		seen[root.Path] = true
+		for _, pattern := range root.Exclude {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				errs = append(errs, fmt.Errorf("roots[%d]: invalid exclude pattern %q", i, pattern))
+			}
+		}
+		if root.MaxDepth < 0 {
+			errs = append(errs, fmt.Errorf("roots[%d]: max_depth must not be negative", i))
+		}
+		switch root.Symlinks {
+		case SymlinksIgnore, SymlinksRecord, SymlinksFollow:
+		default:
+			errs = append(errs, fmt.Errorf("roots[%d]: unknown symlinks policy %q", i, root.Symlinks))
+		}
+		if _, err := parseSchedule(root.Schedule); err != nil {
+			errs = append(errs, fmt.Errorf("roots[%d]: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// findRoot returns the configured root at path.
+func findRoot(cfg *ConfigDatabase, path string) (Root, bool) {
+	path = filepath.Clean(path)
+	for _, root := range cfg.Roots {
+		if root.Path == path {
+			return root, true
+		}
+	}
+	return Root{}, false
+}
+
+// RootStatus describes a configured root, as sent to clients.
+type RootStatus struct {
+	Root
+	// Zero until the root was indexed.
+	Indexed time.Time
+	Files   int
+}
+
+// rootRecord is what is saved about an indexed root.
+type rootRecord struct {
+	Indexed time.Time
+	Files   int
+}
+
+// rootRecords guards the file with the records of the indexed roots.
+var rootRecords sync.Mutex
+
+// rootsFile returns the path of the records of the indexed roots.
+func rootsFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "roots.gob")
+}
+
+func loadRootRecords(cfg *ConfigDatabase) map[string]rootRecord {
+	records := make(map[string]rootRecord)
+	file, err := os.Open(rootsFile(cfg))
+	if err != nil {
+		return records
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(file).Decode(&records); err != nil {
+		slog.Error("Error loading root records", "err", err)
+	}
+	return records
+}
+
+// updateRootRecords lets fn change the records of the indexed roots and
+// saves them.
+func updateRootRecords(cfg *ConfigDatabase, fn func(records map[string]rootRecord)) error {
+	rootRecords.Lock()
+	defer rootRecords.Unlock()
+
+	records := loadRootRecords(cfg)
+	fn(records)
+
+	filename := rootsFile(cfg)
+	tmpName := filename + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	err = gob.NewEncoder(file).Encode(records)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// recordIndexed saves that root was indexed with the given number of files.
+// Roots that are not configured are indexed once and not kept track of.
+func recordIndexed(cfg *ConfigDatabase, root Root, files int) {
+	if _, ok := findRoot(cfg, root.Path); !ok {
+		return
+	}
+	err := updateRootRecords(cfg, func(records map[string]rootRecord) {
+		records[root.Path] = rootRecord{Indexed: time.Now(), Files: files}
+	})
+	if err != nil {
+		slog.Error("Error saving root records", "err", err)
+	}
+}
+
+// listRoots returns the configured roots and when they were indexed.
+func listRoots(cfg *ConfigDatabase) []RootStatus {
+	rootRecords.Lock()
+	records := loadRootRecords(cfg)
+	rootRecords.Unlock()
+
+	roots := []RootStatus{}
+	for _, root := range cfg.Roots {
+		record := records[root.Path]
+		roots = append(roots, RootStatus{Root: root, Indexed: record.Indexed, Files: record.Files})
+	}
+	return roots
+}
+
+// ensureRoots indexes the configured roots that are not indexed yet, and
+// removes the roots that are no longer configured from the index, logging
+// to logger.
+func ensureRoots(cfg *ConfigDatabase, logger *slog.Logger) {
+	rootRecords.Lock()
+	records := loadRootRecords(cfg)
+	rootRecords.Unlock()
+
+	if _, err := os.Stat(indexFile(cfg)); os.IsNotExist(err) {
+		if len(cfg.Roots) == 0 {
+			return
+		}
+		logger.Info("No index yet, indexing every root")
+		if err := indexRoots(cfg.Roots, cfg, logger, nil); err != nil {
+			logger.Error("Error indexing roots", "err", err)
+		}
+		return
+	}
+
+	var stale []string
+	for path := range records {
+		if _, ok := findRoot(cfg, path); !ok {
+			stale = append(stale, path)
+		}
+	}
+	if len(stale) > 0 {
+		logger.Info("Removing roots that are no longer configured", "roots", stale)
+		if err := removeRoots(stale, cfg); err != nil {
+			logger.Error("Error removing roots", "err", err)
+		}
+	}
+
+	for _, root := range cfg.Roots {
+		// Removing a root above this one removed its files too.
+		removed := false
+		for _, path := range stale {
+			removed = removed || strings.HasPrefix(root.Path, strings.TrimSuffix(path, "/")+"/")
+		}
+		if records[root.Path].Indexed.IsZero() || removed {
+			logger.Info("Root is not indexed yet", "root", root.Path)
+			if err := indexRoot(root, cfg, logger, nil); err != nil {
+				logger.Error("Error indexing root", "root", root.Path, "err", err)
+			}
+		}
+	}
+}
+
+// removeRoots drops the files below paths from the index, except for those
+// that are inside another configured root.
+func removeRoots(paths []string, cfg *ConfigDatabase) error {
+	indexLock.Lock()
+	defer indexLock.Unlock()
+
+	var dirs []string
+	for _, path := range paths {
+		if !insideRoot(cfg, path) {
+			dirs = append(dirs, path)
+		}
+	}
+	if err := rewriteIndexes(cfg, dirs, nil); err != nil {
+		return err
+	}
+
+	return updateRootRecords(cfg, func(records map[string]rootRecord) {
+		for _, path := range paths {
+			delete(records, path)
+		}
+	})
+}
+
+// insideRoot reports whether path is below one of the configured roots.
+func insideRoot(cfg *ConfigDatabase, path string) bool {
+	for _, root := range cfg.Roots {
+		if strings.HasPrefix(path, strings.TrimSuffix(root.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScheduleStatus describes a scheduled root, as sent to clients.
+type ScheduleStatus struct {
+	Root     string
+	Schedule string
+	Running  bool
+	// Zero until the root was indexed by the scheduler.
+	LastRun      time.Time
+	LastDuration time.Duration
+	LastError    string `json:",omitempty"`
+	// Zero when the schedule never runs again.
+	NextRun time.Time
+}
+
+// indexScheduler is the scheduler of the running daemon. A reload replaces
+// it while requests read it, like runningConfig.
+var indexScheduler atomic.Pointer[Scheduler]
+
+// Scheduler indexes roots again on their schedules. Each root is run by its
+// own goroutine, so a run never overlaps the previous run of the same root.
+// The time of the last run is saved, so runs missed while the daemon was
+// down are caught up once when it starts.
+type Scheduler struct {
+	mu        sync.Mutex
+	jobs      []*scheduledJob
+	stateFile string
+	index     func(root string) error
+	stop      chan struct{}
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+type scheduledJob struct {
+	root     string
+	spec     string
+	schedule schedule
+	// Largest random delay added to every run, so that daemons sharing a
+	// schedule do not all start at the same time.
+	jitter time.Duration
+
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+	nextRun      time.Time
+	running      bool
+}
+
+// scheduleStateFile returns the path of the saved scheduler state.
+func scheduleStateFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "schedule.gob")
+}
+
+// NewScheduler returns a scheduler that calls index for every run. The time
+// of the last runs is kept in stateFile.
+func NewScheduler(stateFile string, index func(root string) error) *Scheduler {
+	return &Scheduler{
+		stateFile: stateFile,
+		index:     index,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Add schedules root to be indexed on spec, see parseSchedule. Roots with
+// the "off" schedule are not added.
+func (s *Scheduler) Add(root, spec string, jitter time.Duration) error {
+	sched, err := parseSchedule(spec)
+	if err != nil || sched == nil {
+		return err
+	}
+	s.jobs = append(s.jobs, &scheduledJob{
+		root:     root,
+		spec:     spec,
+		schedule: sched,
+		jitter:   jitter,
+	})
+	return nil
+}
+
+// Start plans the next run of every root and starts waiting for them.
+func (s *Scheduler) Start() {
+	lastRuns := s.loadState()
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		job.lastRun = lastRuns[job.root]
+		job.nextRun = job.plan(now)
+		if !job.nextRun.IsZero() {
+			slog.Info("Next scheduled index", "root", job.root, "at", job.nextRun.Format(time.RFC3339))
+		}
+		s.wg.Add(1)
+		go s.loop(job)
+	}
+}
+
+// Stop stops planning runs and waits for running ones to finish.
+func (s *Scheduler) Stop() {
+	s.Halt()
+	s.wg.Wait()
+}
+
+// Halt stops planning runs without waiting for running ones to finish.
+func (s *Scheduler) Halt() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// plan returns the time of the next run. A run that was missed is done as
+// soon as possible, but only once however many were missed.
+func (job *scheduledJob) plan(now time.Time) time.Time {
+	base := job.lastRun
+	if base.IsZero() {
+		base = now
+	}
+	next := job.schedule.Next(base)
+	if next.IsZero() {
+		return next
+	}
+	if next.Before(now) {
+		next = now
+	}
+	if job.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(job.jitter))))
+	}
+	return next
+}
+
+func (s *Scheduler) loop(job *scheduledJob) {
+	defer s.wg.Done()
+	for {
+		s.mu.Lock()
+		next := job.nextRun
+		s.mu.Unlock()
+		if next.IsZero() {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+		s.run(job)
+	}
+}
+
+func (s *Scheduler) run(job *scheduledJob) {
+	s.mu.Lock()
+	job.running = true
+	s.mu.Unlock()
+
+	slog.Info("Scheduled index", "root", job.root)
+	start := time.Now()
+	err := s.index(job.root)
+	duration := time.Since(start)
+	// A run cancelled by stopping the daemon is caught up on the next start.
+	if errors.Is(err, errShuttingDown) {
+		s.mu.Lock()
+		job.running = false
+		s.mu.Unlock()
+		return
+	}
+	if err != nil {
+		slog.Error("Scheduled index failed", "root", job.root, "err", err)
+	}
+
+	s.mu.Lock()
+	job.running = false
+	job.lastRun = start
+	job.lastDuration = duration
+	job.lastError = ""
+	if err != nil {
+		job.lastError = err.Error()
+	}
+	job.nextRun = job.plan(time.Now())
+	err = s.saveState()
+	s.mu.Unlock()
+	if err != nil {
+		slog.Error("Error saving schedule state", "err", err)
+	}
+}
+
+// Status returns the state of every scheduled root.
+func (s *Scheduler) Status() []ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := []ScheduleStatus{}
+	for _, job := range s.jobs {
+		status = append(status, ScheduleStatus{
+			Root:         job.root,
+			Schedule:     job.spec,
+			Running:      job.running,
+			LastRun:      job.lastRun,
+			LastDuration: job.lastDuration,
+			LastError:    job.lastError,
+			NextRun:      job.nextRun,
+		})
+	}
+	return status
+}
+
+// loadState returns the time of the last run of every root.
+func (s *Scheduler) loadState() map[string]time.Time {
+	lastRuns := make(map[string]time.Time)
+	file, err := os.Open(s.stateFile)
+	if err != nil {
+		return lastRuns
+	}
+	defer file.Close()
+	if err := gob.NewDecoder(file).Decode(&lastRuns); err != nil {
+		slog.Error("Error loading schedule state", "err", err)
+	}
+	return lastRuns
+}
+
+// saveState saves the time of the last run of every root. The caller must
+// hold the lock.
+func (s *Scheduler) saveState() error {
+	lastRuns := make(map[string]time.Time)
+	for _, job := range s.jobs {
+		if !job.lastRun.IsZero() {
+			lastRuns[job.root] = job.lastRun
+		}
+	}
+
+	tmpName := s.stateFile + ".tmp"
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	err = gob.NewEncoder(file).Encode(lastRuns)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, s.stateFile)
+}
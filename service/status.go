@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// version is set when building with -ldflags "-X main.version=...".
+var version = "dev"
+
+// daemonStarted is when the daemon started serving.
+var daemonStarted time.Time
+
+// DaemonStatus describes the running daemon, as sent to clients.
+type DaemonStatus struct {
+	PID     int
+	Version string
+	Started time.Time
+	Uptime  time.Duration
+	Indexes []IndexStatus
+}
+
+// IndexStatus describes an index file of the daemon.
+type IndexStatus struct {
+	Name     string
+	File     string
+	Size     int64
+	Modified time.Time
+	Age      time.Duration
+	// Kept in memory between searches
+	Loaded bool
+	// Nodes in the trie, names in the name index or files in the content
+	// index, known while the index is loaded
+	Entries int `json:",omitempty"`
+}
+
+// printStatus prints the status of the running daemon.
+func printStatus(cfg *ConfigDatabase) {
+	status, err := queryStatus(cfg.Server.Port)
+	if err != nil {
+		if pid, ok := findDaemon(cfg); ok {
+			log.Printf("vfmpd (pid %d) is running but does not answer on port %d: %v", pid, cfg.Server.Port, err)
+		} else {
+			log.Print("vfmpd is not running")
+		}
+		return
+	}
+
+	log.Print("vfmpd is running")
+	log.Print("PID: ", status.PID)
+	log.Print("Version: ", status.Version)
+	log.Printf("Uptime: %s (since %s)", status.Uptime, status.Started.Format(time.RFC3339))
+	if len(status.Indexes) == 0 {
+		log.Print("No indexes yet")
+	}
+	for _, index := range status.Indexes {
+		loaded := ""
+		if index.Loaded {
+			loaded = fmt.Sprintf(", loaded with %d entries", index.Entries)
+		}
+		log.Printf("Index %s: %s, %d bytes, modified %s%s", index.Name, index.File, index.Size, index.Modified.Format(time.RFC3339), loaded)
+	}
+}
+
+// queryStatus asks the daemon on port for its status.
+func queryStatus(port int) (DaemonStatus, error) {
+	var status DaemonStatus
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), 3*time.Second)
+	if err != nil {
+		return status, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = conn.Write([]byte("{\"type\":\"status\"}\n"))
+	if err != nil {
+		return status, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return status, err
+	}
+	var msg IPCMessage
+	if err := json.Unmarshal([]byte(reply), &msg); err != nil {
+		return status, err
+	}
+	err = json.Unmarshal([]byte(msg.Data), &status)
+	return status, err
+}
+
+func processStatus(conn net.Conn, cfg *ConfigDatabase) {
+	connLog(conn).Info("Status")
+	sendJSON(conn, "status", daemonStatus(cfg))
+}
+
+// daemonStatus returns the status of this daemon and its index files. Files
+// that were not built are left out.
+func daemonStatus(cfg *ConfigDatabase) DaemonStatus {
+	status := DaemonStatus{
+		PID:     os.Getpid(),
+		Version: version,
+		Started: daemonStarted,
+		Uptime:  time.Since(daemonStarted).Round(time.Second),
+		Indexes: []IndexStatus{},
+	}
+
+	trie := IndexStatus{Name: "trie", File: indexFile(cfg)}
+	mappedIndex.RLock()
+	if mappedIndex.index != nil && mappedIndex.file == trie.File {
+		trie.Loaded = true
+		trie.Entries = int(mappedIndex.index.nodeCount)
+	}
+	mappedIndex.RUnlock()
+
+	names := IndexStatus{Name: "names", File: nameIndexFile(cfg)}
+	loadedNames.Lock()
+	if loadedNames.index != nil && loadedNames.file == names.File {
+		names.Loaded = true
+		names.Entries = len(loadedNames.index.Keys)
+	}
+	loadedNames.Unlock()
+
+	content := IndexStatus{Name: "content", File: contentIndexFile(cfg)}
+	loadedContent.Lock()
+	if loadedContent.index != nil && loadedContent.file == content.File {
+		content.Loaded = true
+		content.Entries = len(loadedContent.index.Files)
+	}
+	loadedContent.Unlock()
+
+	for _, index := range []IndexStatus{trie, names, content} {
+		info, err := os.Stat(index.File)
+		if err != nil {
+			continue
+		}
+		index.Size = info.Size()
+		index.Modified = info.ModTime()
+		index.Age = time.Since(info.ModTime()).Round(time.Second)
+		status.Indexes = append(status.Indexes, index)
+	}
+	return status
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// StreamBuilder writes a flat index without holding the whole trie in memory.
+// Paths are spilled to disk in sorted runs while walking, and Finish merges
+// the runs into the final index file. Memory use is bounded by the budget,
+// plus the entries of the widest directory being written at any time.
+type StreamBuilder struct {
+	dir    string
+	budget int
+	opts   NameOptions
+	paths  *runSorter
+	err    error
+}
+
+// NewStreamBuilder creates a builder that keeps its temporary files in a new
+// directory inside dataDir and uses about budget bytes of memory.
+func NewStreamBuilder(dataDir string, budget int, opts NameOptions) (*StreamBuilder, error) {
+	dir, err := os.MkdirTemp(dataDir, "build-")
+	if err != nil {
+		return nil, err
+	}
+	// The path runs and the label runs are never filled at the same time,
+	// but they are merged at the same time, so each gets half of the budget.
+	return &StreamBuilder{
+		dir:    dir,
+		budget: budget / 2,
+		opts:   opts,
+		paths:  newRunSorter(dir, budget/2),
+	}, nil
+}
+
+// AddFile adds a file to the index. Errors are kept and reported by Finish.
+func (b *StreamBuilder) AddFile(path string, info os.FileInfo) {
+	b.add(path, info.ModTime().Unix(), info.Size(), linkTarget(info))
+}
+
+// add adds a file with the metadata it was saved with in another index.
+func (b *StreamBuilder) add(path string, modTime, size int64, link string) {
+	if b.err != nil {
+		return
+	}
+	// Sorting with the separator as the lowest byte keeps every directory's
+	// children together and in the same order as the flat index expects.
+	path = strings.ReplaceAll(path, "\\", "/")
+	b.err = b.paths.Add(encodePathRecord(strings.ReplaceAll(path, "/", "\x00"), modTime, size, link))
+}
+
+// Abort removes the temporary files without writing an index. It does
+// nothing once the builder is finished, so it can be deferred right after
+// the builder is created.
+func (b *StreamBuilder) Abort() {
+	if b.dir == "" {
+		return
+	}
+	os.RemoveAll(b.dir)
+	b.dir = ""
+}
+
+// Finish merges the spilled runs and writes the flat index to filename. The
+// temporary files are removed whether it succeeds or not.
+func (b *StreamBuilder) Finish(filename string) error {
+	defer b.Abort()
+	if b.err != nil {
+		return b.err
+	}
+
+	nodesFile, err := os.Create(b.dir + "/nodes")
+	if err != nil {
+		return err
+	}
+	defer nodesFile.Close()
+	dirsFile, err := os.Create(b.dir + "/dirs")
+	if err != nil {
+		return err
+	}
+	defer dirsFile.Close()
+
+	// Build the nodes from the sorted paths. Labels are not known yet, so
+	// every node is sent to the label sorter and patched afterwards.
+	w := &streamNodeWriter{
+		nodes:  bufio.NewWriter(nodesFile),
+		dirs:   bufio.NewWriter(dirsFile),
+		labels: newRunSorter(b.dir, b.budget),
+		opts:   b.opts,
+		stack:  []*streamNode{{}},
+	}
+	last := ""
+	err = b.paths.Merge(func(record string) error {
+		path, modTime, size, link := decodePathRecord(record)
+		if path == last {
+			return nil
+		}
+		last = path
+		return w.add(strings.Split(path, "\x00"), modTime, size, link)
+	})
+	if err != nil {
+		return err
+	}
+	root, err := w.finish()
+	if err != nil {
+		return err
+	}
+	for _, f := range []*bufio.Writer{w.nodes, w.dirs} {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+	nodeCount := w.count
+
+	nodes, err := mapFile(nodesFile, uint64(nodeCount)*flatNodeSize, true)
+	if err != nil {
+		return fmt.Errorf("unable to map nodes: %w", err)
+	}
+	defer unmapFile(nodes)
+
+	for id := uint32(0); id < nodeCount; id++ {
+		record := nodes[uint64(id)*flatNodeSize:]
+		first := binary.LittleEndian.Uint32(record[flatNodeFirstChild:])
+		count := binary.LittleEndian.Uint32(record[flatNodeChildCount:])
+		for c := first; c < first+count; c++ {
+			binary.LittleEndian.PutUint32(nodes[uint64(c)*flatNodeSize+flatNodeParent:], id)
+		}
+	}
+
+	// Merge the labels and name keys to build the sorted string table, fill
+	// in the label of every node and list the end-of-word nodes in key order.
+	offsetsFile, err := os.Create(b.dir + "/offsets")
+	if err != nil {
+		return err
+	}
+	defer offsetsFile.Close()
+	blobFile, err := os.Create(b.dir + "/blob")
+	if err != nil {
+		return err
+	}
+	defer blobFile.Close()
+	namesFile, err := os.Create(b.dir + "/names")
+	if err != nil {
+		return err
+	}
+	defer namesFile.Close()
+
+	offsets := bufio.NewWriter(offsetsFile)
+	blob := bufio.NewWriter(blobFile)
+	names := bufio.NewWriter(namesFile)
+
+	var stringCount, nameCount, blobSize uint32
+	var buf [flatNameSize]byte
+	lastLabel := ""
+	err = w.labels.Merge(func(record string) error {
+		label, id, kind := decodeLabelRecord(record)
+		if stringCount == 0 || label != lastLabel {
+			binary.LittleEndian.PutUint32(buf[:], blobSize)
+			if _, err := offsets.Write(buf[:4]); err != nil {
+				return err
+			}
+			if _, err := blob.WriteString(label); err != nil {
+				return err
+			}
+			blobSize += uint32(len(label))
+			stringCount++
+			lastLabel = label
+		}
+		if kind&labelRecordLabel != 0 {
+			binary.LittleEndian.PutUint32(nodes[uint64(id)*flatNodeSize+flatNodeLabel:], stringCount-1)
+		}
+		if kind&labelRecordLink != 0 {
+			binary.LittleEndian.PutUint32(nodes[uint64(id)*flatNodeSize+flatNodeLink:], stringCount-1)
+		}
+		if kind&labelRecordName != 0 {
+			binary.LittleEndian.PutUint32(buf[:], stringCount-1)
+			binary.LittleEndian.PutUint32(buf[4:], id)
+			if _, err := names.Write(buf[:]); err != nil {
+				return err
+			}
+			nameCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint32(buf[:], blobSize)
+	if _, err := offsets.Write(buf[:4]); err != nil {
+		return err
+	}
+	for _, f := range []*bufio.Writer{offsets, blob, names} {
+		if err := f.Flush(); err != nil {
+			return err
+		}
+	}
+
+	header := flatHeader{
+		stringCount: stringCount,
+		nodeCount:   nodeCount,
+		nameCount:   nameCount,
+		dirCount:    w.dirCount,
+		root:        root,
+		opts:        b.opts,
+	}
+	header.stringsOff = flatHeaderSize
+	header.nodesOff = header.stringsOff + 4*(uint64(stringCount)+1) + uint64(blobSize)
+	header.namesOff = header.nodesOff + uint64(nodeCount)*flatNodeSize
+	header.dirsOff = header.namesOff + flatNameSize*uint64(nameCount)
+
+	tmpName := filename + ".tmp"
+	out, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	err = func() error {
+		if _, err := out.Write(header.encode()); err != nil {
+			return err
+		}
+		for _, f := range []*os.File{offsetsFile, blobFile} {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, f); err != nil {
+				return err
+			}
+		}
+		if _, err := out.Write(nodes); err != nil {
+			return err
+		}
+		for _, f := range []*os.File{namesFile, dirsFile} {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
+
+// streamNode is a directory that is still receiving children.
+type streamNode struct {
+	label    string
+	end      bool
+	modTime  int64
+	size     int64
+	link     string
+	children []streamChild
+}
+
+// streamChild is a finished node waiting to be written with its siblings.
+type streamChild struct {
+	label      string
+	end        bool
+	modTime    int64
+	size       int64
+	link       string
+	firstChild uint32
+	childCount uint32
+	// The files below the node
+	below dirSummary
+}
+
+// streamNodeWriter turns sorted paths into flat index nodes. The children of
+// a node are written together once the sorted input has moved past it.
+type streamNodeWriter struct {
+	nodes    *bufio.Writer
+	dirs     *bufio.Writer
+	labels   *runSorter
+	opts     NameOptions
+	stack    []*streamNode
+	count    uint32
+	dirCount uint32
+}
+
+func (w *streamNodeWriter) add(parts []string, modTime, size int64, link string) error {
+	// Find how much of the path is shared with the previous one.
+	common := 0
+	for common < len(parts) && common+1 < len(w.stack) && w.stack[common+1].label == parts[common] {
+		common++
+	}
+	for len(w.stack) > common+1 {
+		if err := w.pop(); err != nil {
+			return err
+		}
+	}
+	for _, part := range parts[common:] {
+		w.stack = append(w.stack, &streamNode{label: part})
+	}
+	w.stack[len(w.stack)-1].end = true
+	w.stack[len(w.stack)-1].modTime = modTime
+	w.stack[len(w.stack)-1].size = size
+	w.stack[len(w.stack)-1].link = link
+	return nil
+}
+
+// pop writes the children of the innermost open node and hands the node
+// itself over to its parent.
+func (w *streamNodeWriter) pop() error {
+	node := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+
+	first, err := w.writeChildren(node.children)
+	if err != nil {
+		return err
+	}
+	parent := w.stack[len(w.stack)-1]
+	parent.children = append(parent.children, streamChild{
+		label:      node.label,
+		end:        node.end,
+		modTime:    node.modTime,
+		size:       node.size,
+		link:       node.link,
+		firstChild: first,
+		childCount: uint32(len(node.children)),
+		below:      w.summarize(node.children),
+	})
+	return nil
+}
+
+// summarize returns the summary of the files at or below children.
+func (w *streamNodeWriter) summarize(children []streamChild) dirSummary {
+	sum := newDirSummary()
+	for i := range children {
+		child := &children[i]
+		sum.merge(&child.below)
+		if child.end {
+			sum.add(child.label, w.opts.Key(child.label), child.size, child.modTime)
+		}
+	}
+	return sum
+}
+
+func (w *streamNodeWriter) writeChildren(children []streamChild) (uint32, error) {
+	first := w.count
+	var record [flatNodeSize]byte
+	var dirRecord []byte
+	for _, child := range children {
+		var flags uint32
+		if child.end {
+			flags |= flatFlagEndOfWord
+		}
+		dir := uint32(flatNoDir)
+		if child.childCount > 0 {
+			dir = w.dirCount
+			dirRecord = appendDirSummary(dirRecord[:0], &child.below)
+			if _, err := w.dirs.Write(dirRecord); err != nil {
+				return 0, err
+			}
+			w.dirCount++
+		}
+		binary.LittleEndian.PutUint32(record[flatNodeLabel:], 0)
+		binary.LittleEndian.PutUint32(record[flatNodeParent:], 0)
+		binary.LittleEndian.PutUint32(record[flatNodeFirstChild:], child.firstChild)
+		binary.LittleEndian.PutUint32(record[flatNodeChildCount:], child.childCount)
+		binary.LittleEndian.PutUint32(record[flatNodeFlags:], flags)
+		binary.LittleEndian.PutUint64(record[flatNodeModTime:], uint64(child.modTime))
+		binary.LittleEndian.PutUint64(record[flatNodeFileSize:], uint64(child.size))
+		// The link is filled in with the labels, the empty string is id 0.
+		binary.LittleEndian.PutUint32(record[flatNodeLink:], 0)
+		binary.LittleEndian.PutUint32(record[flatNodeDir:], dir)
+		if _, err := w.nodes.Write(record[:]); err != nil {
+			return 0, err
+		}
+		// End-of-word nodes also need their name key in the string table.
+		kind := byte(labelRecordLabel)
+		if child.end {
+			if key := w.opts.Key(child.label); key != child.label {
+				if err := w.labels.Add(encodeLabelRecord(key, w.count, labelRecordName)); err != nil {
+					return 0, err
+				}
+			} else {
+				kind |= labelRecordName
+			}
+		}
+		if err := w.labels.Add(encodeLabelRecord(child.label, w.count, kind)); err != nil {
+			return 0, err
+		}
+		if child.link != "" {
+			if err := w.labels.Add(encodeLabelRecord(child.link, w.count, labelRecordLink)); err != nil {
+				return 0, err
+			}
+		}
+		w.count++
+	}
+	return first, nil
+}
+
+// finish closes every open node and writes the root, returning its id.
+func (w *streamNodeWriter) finish() (uint32, error) {
+	for len(w.stack) > 1 {
+		if err := w.pop(); err != nil {
+			return 0, err
+		}
+	}
+	root := w.stack[0]
+	first, err := w.writeChildren(root.children)
+	if err != nil {
+		return 0, err
+	}
+	return w.writeChildren([]streamChild{{firstChild: first, childCount: uint32(len(root.children)), below: w.summarize(root.children)}})
+}
+
+// Path records hold a path with its separators replaced by zero bytes, then
+// two zero bytes, the modification time, the size, the link target and the
+// length of the link target. Only the first segment of a path can be empty,
+// so the records sort like the paths alone.
+func encodePathRecord(path string, modTime, size int64, link string) string {
+	record := make([]byte, 0, len(path)+len(link)+22)
+	record = append(record, path...)
+	record = append(record, 0, 0)
+	record = binary.BigEndian.AppendUint64(record, uint64(modTime))
+	record = binary.BigEndian.AppendUint64(record, uint64(size))
+	record = append(record, link...)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(link)))
+	return string(record)
+}
+
+func decodePathRecord(record string) (string, int64, int64, string) {
+	linkLen := int(binary.BigEndian.Uint32([]byte(record[len(record)-4:])))
+	link := record[len(record)-4-linkLen : len(record)-4]
+	n := len(record) - 4 - linkLen - 18
+	meta := []byte(record[n+2:])
+	return record[:n], int64(binary.BigEndian.Uint64(meta)), int64(binary.BigEndian.Uint64(meta[8:])), link
+}
+
+// Kinds of label records. A string may be the label of a node, the name key
+// of an end-of-word node or both. Link targets are kept in the same table.
+const (
+	labelRecordLabel = 1
+	labelRecordName  = 2
+	labelRecordLink  = 4
+)
+
+// Label records sort by string, then by node id.
+func encodeLabelRecord(label string, id uint32, kind byte) string {
+	record := make([]byte, 0, len(label)+6)
+	record = append(record, label...)
+	record = append(record, 0)
+	record = binary.BigEndian.AppendUint32(record, id)
+	record = append(record, kind)
+	return string(record)
+}
+
+func decodeLabelRecord(record string) (string, uint32, byte) {
+	n := len(record) - 6
+	return record[:n], binary.BigEndian.Uint32([]byte(record[n+1 : n+5])), record[n+5]
+}
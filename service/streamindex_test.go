@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRunSorter(t *testing.T) {
+	dir := t.TempDir()
+	// Every string goes over the budget, so each one is spilled to a run.
+	sorter := newRunSorter(dir, 1)
+	in := []string{"b", "d", "a", "c", "b", "", "ab"}
+	for _, str := range in {
+		if err := sorter.Add(str); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sorter.runs) != len(in) {
+		t.Fatalf("%d runs, want %d", len(sorter.runs), len(in))
+	}
+
+	var got []string
+	err := sorter.Merge(func(str string) error {
+		got = append(got, str)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{}, in...)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Merge = %q, want %q", got, want)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d run files left after Merge", len(entries))
+	}
+}
+
+// trieFiles returns every file of trie with its metadata.
+func trieFiles(trie *HybridTrie) map[string]string {
+	files := make(map[string]string)
+	trie.walkHelper(trie.root(), "", func(path string, node *TrieNode) {
+		files[path] = fmt.Sprint(node.Size, node.ModTime, node.Link)
+	})
+	return files
+}
+
+func TestStreamBuilder(t *testing.T) {
+	dir := t.TempDir()
+	opts := NameOptions{IgnoreCase: true}
+	trie := NewHybridTrie(opts)
+	// A budget this small spills the paths and the labels to many runs.
+	builder, err := NewStreamBuilder(dir, 512, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var infos []os.FileInfo
+	for i := 0; i < 300; i++ {
+		name := fmt.Sprintf("/data/d%d/s%d/File%d.txt", i%7, i%3, i)
+		infos = append(infos, testFileInfo{name: name, size: int64(i), modTime: modTime.Add(time.Duration(i) * time.Hour)})
+	}
+	infos = append(infos,
+		testFileInfo{name: "/data/d1", size: 1},
+		testFileInfo{name: "/data/only/one/deep/file.txt", size: 2},
+		linkInfo{FileInfo: testFileInfo{name: "/data/link"}, target: "/data/d1"},
+	)
+	for _, info := range infos {
+		trie.AddFile(info.Name(), info)
+		builder.AddFile(info.Name(), info)
+	}
+	// Adding a file twice keeps one copy, like the trie.
+	builder.AddFile(infos[0].Name(), infos[0])
+	if len(builder.paths.runs) < 2 {
+		t.Fatalf("%d path runs, want the builder to spill", len(builder.paths.runs))
+	}
+
+	filename := filepath.Join(dir, "trie.idx")
+	if err := builder.Finish(filename); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the data dir after Finish, want only the index", len(entries))
+	}
+
+	index, err := OpenFlatIndex(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err := index.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded HybridTrie
+	index.toTrie(&loaded)
+	if got, want := trieShape(&loaded), trieShape(trie); got != want {
+		t.Errorf("shape = %s, want %s", got, want)
+	}
+	if got, want := trieFiles(&loaded), trieFiles(trie); !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+
+	// Search rebuilds paths from the parents patched in after the merge.
+	for _, name := range []string{"file7.txt", "FILE.TXT", "d1", "link", "missing"} {
+		got, want := index.Search(name), trie.Search(name)
+		sort.Strings(got)
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Search(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	sddaemon "github.com/coreos/go-systemd/v22/daemon"
+)
+
+// listen returns the listener passed by systemd socket activation, or a new
+// one on the configured port.
+func listen(cfg *ConfigDatabase) (net.Listener, error) {
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, listener := range listeners {
+		if listener != nil {
+			slog.Info("Using the socket passed by systemd", "addr", listener.Addr())
+			return listener, nil
+		}
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%d", cfg.Server.Port))
+}
+
+// notifyReady tells systemd that the daemon is ready. If the unit has a
+// watchdog, it is pinged as long as the daemon answers a ping on addr the
+// way clients are answered. Without systemd it does nothing.
+func notifyReady(addr net.Addr) {
+	sent, err := sddaemon.SdNotify(false, sddaemon.SdNotifyReady)
+	if err != nil {
+		slog.Error("Error notifying systemd", "err", err)
+	}
+	if !sent {
+		return
+	}
+
+	interval, err := sddaemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval / 2) {
+			// Stopping may take longer than a check, and systemd
+			// enforces its own stop timeout.
+			if !shuttingDown() {
+				if err := selfCheck(addr, interval/4); err != nil {
+					slog.Warn("Not pinging the watchdog, the daemon does not answer", "err", err)
+					continue
+				}
+			}
+			sddaemon.SdNotify(false, sddaemon.SdNotifyWatchdog)
+		}
+	}()
+}
+
+// selfCheck connects to the daemon on addr and sends a ping, which goes
+// through the accept loop and the message handling like any request.
+func selfCheck(addr net.Addr, timeout time.Duration) error {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	conn, err := net.DialTimeout(addr.Network(), net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	_, err = conn.Write([]byte("{\"type\":\"ping\"}\n"))
+	if err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	var msg IPCMessage
+	if err := json.Unmarshal([]byte(reply), &msg); err != nil {
+		return err
+	}
+	if msg.Type != "pong" {
+		return fmt.Errorf("unexpected reply %q", msg.Type)
+	}
+	return nil
+}
+
+const serviceUnit = `[Unit]
+Description=VFMP file indexing daemon
+After=local-fs.target
+{{requires}}
+[Service]
+Type=notify
+ExecStart={{exec}} run --foreground
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+WatchdogSec=30
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const socketUnit = `[Unit]
+Description=VFMP file indexing daemon socket
+
+[Socket]
+ListenStream={{port}}
+
+[Install]
+WantedBy=sockets.target
+`
+
+// installService writes a systemd unit that runs this executable in the
+// foreground, and a socket unit for the configured port if socket is set.
+// With dir set to "-" the units are printed instead.
+func installService(cfg *ConfigDatabase, dir string, socket bool) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("unable to find the executable: %w", err)
+	}
+
+	requires := ""
+	if socket {
+		requires = "Requires=vfmpd.socket\n"
+	}
+	units := map[string]string{
+		"vfmpd.service": strings.NewReplacer("{{exec}}", executable, "{{requires}}", requires).Replace(serviceUnit),
+	}
+	if socket {
+		units["vfmpd.socket"] = strings.ReplaceAll(socketUnit, "{{port}}", fmt.Sprint(cfg.Server.Port))
+	}
+
+	for _, name := range []string{"vfmpd.service", "vfmpd.socket"} {
+		unit, ok := units[name]
+		if !ok {
+			continue
+		}
+		if dir == "-" {
+			fmt.Printf("# %s\n%s\n", name, unit)
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(unit), 0644); err != nil {
+			return err
+		}
+		log.Print("Wrote ", filename)
+	}
+	if dir != "-" {
+		enable := "vfmpd.service"
+		if socket {
+			enable = "vfmpd.socket"
+		}
+		log.Printf("Run `systemctl daemon-reload && systemctl enable --now %s` to start it", enable)
+	}
+	return nil
+}
@@ -1,101 +1,357 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
 
-	"github.com/sahilm/fuzzy"
+	"google.golang.org/protobuf/proto"
 )
 
-func (t *HybridTrie) AddPath(path string) {
+// root returns the root node of the trie, allocating it on first use.
+func (t *HybridTrie) root() *TrieNode {
+	if t.Root == nil {
+		t.Root = &TrieNode{Children: make(map[string]*TrieNode)}
+	}
+	return t.Root
+}
+
+// splitPath normalizes path and splits it into segments.
+func splitPath(path string) []string {
 	path = strings.ReplaceAll(path, "\\", "/") // Normalize path
-	parts := strings.Split(path, "/")          // Split path into parts
-	node := &t.Root
-	for _, part := range parts {
-		if _, ok := node.Children[part]; !ok {
+	return strings.Split(path, "/")            // Split path into parts
+}
+
+// edge returns the segments of the edge leading to n, which is stored under key.
+func (n *TrieNode) edge(key string) []string {
+	if len(n.Segments) > 0 {
+		return n.Segments
+	}
+	return []string{key}
+}
+
+// NewHybridTrie creates an empty trie that normalizes names with opts.
+func NewHybridTrie(opts NameOptions) *HybridTrie {
+	return &HybridTrie{IgnoreCase: opts.IgnoreCase, Normalization: opts.Normalization}
+}
+
+func (t *HybridTrie) nameOptions() NameOptions {
+	return NameOptions{IgnoreCase: t.IgnoreCase, Normalization: t.Normalization}
+}
+
+// setEdge sets the segments of the edge leading to n and updates its key.
+func (t *HybridTrie) setEdge(n *TrieNode, segments []string) {
+	if len(segments) > 1 {
+		n.Segments = segments
+	} else {
+		n.Segments = nil
+	}
+
+	name := segments[len(segments)-1]
+	if key := t.nameOptions().Key(name); key != name {
+		n.Key = key
+	} else {
+		n.Key = ""
+	}
+}
+
+// nameKey returns the normalized name of n used by exact search.
+func (n *TrieNode) nameKey(key string) string {
+	if n.Key != "" {
+		return n.Key
+	}
+	return n.lastSegment(key)
+}
+
+// label returns the edge leading to n joined back into a partial path.
+func (n *TrieNode) label(key string) string {
+	if len(n.Segments) > 0 {
+		return strings.Join(n.Segments, "/")
+	}
+	return key
+}
+
+// lastSegment returns the file or directory name n stands for.
+func (n *TrieNode) lastSegment(key string) string {
+	if len(n.Segments) > 0 {
+		return n.Segments[len(n.Segments)-1]
+	}
+	return key
+}
+
+// commonSegments returns the length of the common prefix of a and b.
+func commonSegments(a, b []string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func (t *HybridTrie) AddPath(path string) {
+	node, _ := t.insertNode(splitPath(path))
+	node.IsEndOfWord = true
+}
+
+// AddFile adds a file found by walkFiles along with its size, modification
+// time and link target.
+func (t *HybridTrie) AddFile(path string, info os.FileInfo) {
+	node, _ := t.insertNode(splitPath(path))
+	node.IsEndOfWord = true
+	node.ModTime = info.ModTime().Unix()
+	node.Size = info.Size()
+	node.Link = linkTarget(info)
+}
+
+// trieStep is a node on the way from the root to a path, with the key it is
+// stored under in the previous step's node.
+type trieStep struct {
+	node *TrieNode
+	key  string
+}
+
+// insertNode returns the node for parts, splitting edges and creating nodes
+// as needed, and the steps leading to it.
+func (t *HybridTrie) insertNode(parts []string) (*TrieNode, []trieStep) {
+	node := t.root()
+	steps := []trieStep{{node: node}}
+	for len(parts) > 0 {
+		child, ok := node.Children[parts[0]]
+		if !ok {
+			// Nothing shares this prefix, the rest of the path becomes one edge.
 			if node.Children == nil {
 				node.Children = make(map[string]*TrieNode)
 			}
-			node.Children[part] = &TrieNode{Children: make(map[string]*TrieNode)}
+			child = &TrieNode{Children: make(map[string]*TrieNode)}
+			t.setEdge(child, parts)
+			node.Children[parts[0]] = child
+			steps = append(steps, trieStep{node: child, key: parts[0]})
+			return child, steps
+		}
+
+		edge := child.edge(parts[0])
+		common := commonSegments(edge, parts)
+		if common < len(edge) {
+			// The path leaves the edge half way, split it.
+			mid := &TrieNode{Children: map[string]*TrieNode{edge[common]: child}}
+			t.setEdge(mid, edge[:common])
+			t.setEdge(child, edge[common:])
+			node.Children[parts[0]] = mid
+			child = mid
 		}
-		node = node.Children[part]
+		steps = append(steps, trieStep{node: child, key: parts[0]})
+		node = child
+		parts = parts[common:]
 	}
-	node.IsEndOfWord = true
+	return node, steps
 }
 
-func (t *HybridTrie) RemovePath(path string) error {
-	path = strings.ReplaceAll(path, "\\", "/") // Normalize path
-	parts := strings.Split(path, "/")          // Split path into parts
-	node := &t.Root
-	for _, part := range parts {
-		if _, ok := node.Children[part]; !ok {
-			return errors.New("path not found")
+// locate follows parts from the root without changing the trie. It returns
+// the steps taken and, when parts end inside the last step's edge, how many
+// segments of that edge they cover. ok is false if parts are not in the trie.
+func (t *HybridTrie) locate(parts []string) (steps []trieStep, inside int, ok bool) {
+	node := t.root()
+	steps = []trieStep{{node: node}}
+	for len(parts) > 0 {
+		child, ok := node.Children[parts[0]]
+		if !ok {
+			return nil, 0, false
 		}
-		node = node.Children[part]
+		steps = append(steps, trieStep{node: child, key: parts[0]})
+
+		edge := child.edge(parts[0])
+		common := commonSegments(edge, parts)
+		if common < len(edge) {
+			if common == len(parts) {
+				return steps, common, true
+			}
+			return nil, 0, false
+		}
+		node = child
+		parts = parts[common:]
+	}
+	return steps, 0, true
+}
+
+// find returns the node for path, which may only be reached by following
+// whole edges.
+func (t *HybridTrie) find(path string) (*TrieNode, bool) {
+	steps, inside, ok := t.locate(splitPath(path))
+	if !ok || inside > 0 {
+		return nil, false
+	}
+	return steps[len(steps)-1].node, true
+}
+
+// compact removes the child stored under key if nothing is left below it, or
+// merges it with its only child if it is neither a file nor a branch.
+func (t *HybridTrie) compact(parent *TrieNode, key string) {
+	child := parent.Children[key]
+	if child == nil || child.IsEndOfWord {
+		return
+	}
+	switch len(child.Children) {
+	case 0:
+		delete(parent.Children, key)
+	case 1:
+		for grandKey, grandChild := range child.Children {
+			t.setEdge(grandChild, append(append([]string{}, child.edge(key)...), grandChild.edge(grandKey)...))
+			parent.Children[key] = grandChild
+		}
+	}
+}
+
+// reclaim compacts every step from the bottom up, so that branches left
+// empty by a removal are dropped and the trie stays compressed.
+func (t *HybridTrie) reclaim(steps []trieStep) {
+	for i := len(steps) - 1; i >= 1; i-- {
+		t.compact(steps[i-1].node, steps[i].key)
 	}
-	if !node.IsEndOfWord {
+}
+
+// RemovePath removes a file from the trie, along with any directories that
+// are left empty.
+func (t *HybridTrie) RemovePath(path string) error {
+	steps, inside, ok := t.locate(splitPath(path))
+	if !ok || inside > 0 || !steps[len(steps)-1].node.IsEndOfWord {
 		return errors.New("path not found")
 	}
-	node.IsEndOfWord = false
+	steps[len(steps)-1].node.IsEndOfWord = false
+	steps[len(steps)-1].node.ModTime = 0
+	steps[len(steps)-1].node.Size = 0
+	steps[len(steps)-1].node.Link = ""
+	t.reclaim(steps)
+	return nil
+}
+
+// detach removes the subtree at dir from the trie and returns it. If dir ends
+// inside a compressed edge, rest holds the segments of the edge below dir and
+// node is the node that edge leads to.
+func (t *HybridTrie) detach(dir string) (node *TrieNode, rest []string, err error) {
+	steps, inside, ok := t.locate(splitPath(strings.TrimSuffix(dir, "/")))
+	if !ok || len(steps) < 2 {
+		return nil, nil, errors.New("path not found")
+	}
+
+	last := steps[len(steps)-1]
+	if inside > 0 {
+		rest = last.node.edge(last.key)[inside:]
+	}
+	delete(steps[len(steps)-2].node.Children, last.key)
+	t.reclaim(steps[:len(steps)-1])
+	return last.node, rest, nil
+}
+
+// RemoveTree removes a directory and everything below it.
+func (t *HybridTrie) RemoveTree(dir string) error {
+	_, _, err := t.detach(dir)
+	return err
+}
+
+// RenamePath moves a file or a directory with everything below it to a new
+// path. The new path must not exist yet.
+func (t *HybridTrie) RenamePath(oldPath, newPath string) error {
+	oldPath = strings.TrimSuffix(oldPath, "/")
+	newPath = strings.TrimSuffix(newPath, "/")
+	if newPath == oldPath || strings.HasPrefix(newPath, oldPath+"/") {
+		return errors.New("cannot move a path into itself")
+	}
+	if steps, inside, ok := t.locate(splitPath(newPath)); ok {
+		if node := steps[len(steps)-1].node; inside > 0 || node.IsEndOfWord || len(node.Children) > 0 {
+			return errors.New("destination already exists")
+		}
+	}
+
+	node, rest, err := t.detach(oldPath)
+	if err != nil {
+		return err
+	}
+
+	target, steps := t.insertNode(splitPath(newPath))
+	if len(rest) > 0 {
+		t.setEdge(node, rest)
+		target.Children[rest[0]] = node
+	} else {
+		target.IsEndOfWord = node.IsEndOfWord
+		target.ModTime = node.ModTime
+		target.Size = node.Size
+		target.Link = node.Link
+		target.Children = node.Children
+	}
+	t.reclaim(steps)
 	return nil
 }
 
+// Search modes answered by the trie.
+const (
+	SearchExact = "exact"
+	SearchFuzzy = "fuzzy"
+)
+
+// Searcher is implemented by every in-memory or mapped index that can answer search requests.
+type Searcher interface {
+	Search(filename string) []string
+	FuzzySearch(filename string, ranker *Ranker) []Match
+	Query(q *Query, max int) []string
+}
+
 func (t *HybridTrie) Search(filename string) []string {
 	results := []string{}
-	t.searchHelper(&t.Root, "", filename, &results)
+	t.searchHelper(t.root(), "", t.nameOptions().Key(filename), &results)
 	return results
 }
 
-func (t *HybridTrie) searchHelper(node *TrieNode, currentPath, filename string, results *[]string) {
-	for part, child := range node.Children {
-		newPath := currentPath
-		if newPath != "" {
-			newPath += "/"
-		}
-		newPath += part
-		if child.IsEndOfWord && part == filename {
+// searchHelper and getAllPaths take the path of node with a trailing slash,
+// or an empty prefix for the root, so paths keep their leading slash.
+func (t *HybridTrie) searchHelper(node *TrieNode, prefix, filename string, results *[]string) {
+	for key, child := range node.Children {
+		newPath := prefix + child.label(key)
+		if child.IsEndOfWord && child.nameKey(key) == filename {
 			*results = append(*results, newPath)
 		}
-		t.searchHelper(child, newPath, filename, results)
+		t.searchHelper(child, newPath+"/", filename, results)
 	}
 }
 
 type Match struct {
 	Path    string
 	Indexes []int
-	Score   int
-}
-
-func (t *HybridTrie) FuzzySearch(filename string) []Match {
-	paths := t.getAllPaths(&t.Root, "")
-	matches := fuzzy.Find(filename, paths)
-	results := make([]Match, len(matches))
-	for i, match := range matches {
-		results[i] = Match{
-			Path:    match.Str,
-			Indexes: match.MatchedIndexes,
-			Score:   match.Score,
+	Score   float64
+	// How the score was made up, for tuning the ranking weights.
+	Breakdown ScoreBreakdown
+}
+
+func (t *HybridTrie) FuzzySearch(filename string, ranker *Ranker) []Match {
+	return ranker.Rank(filename, t.getAllFiles(t.root(), ""))
+}
+
+// getAllFiles is getAllPaths with the modification time of every file.
+func (t *HybridTrie) getAllFiles(node *TrieNode, prefix string) []rankCandidate {
+	files := []rankCandidate{}
+	for key, child := range node.Children {
+		newPath := prefix + child.label(key)
+		if child.IsEndOfWord {
+			files = append(files, rankCandidate{Path: newPath, ModTime: child.ModTime})
 		}
+		files = append(files, t.getAllFiles(child, newPath+"/")...)
 	}
-	return results
+	return files
 }
 
-func (t *HybridTrie) getAllPaths(node *TrieNode, currentPath string) []string {
+func (t *HybridTrie) getAllPaths(node *TrieNode, prefix string) []string {
 	paths := []string{}
-	if node.IsEndOfWord {
-		paths = append(paths, currentPath)
-	}
-	for part, child := range node.Children {
-		newPath := currentPath
-		if newPath != "" {
-			newPath += "/"
+	for key, child := range node.Children {
+		newPath := prefix + child.label(key)
+		if child.IsEndOfWord {
+			paths = append(paths, newPath)
 		}
-		newPath += part
-		paths = append(paths, t.getAllPaths(child, newPath)...)
+		paths = append(paths, t.getAllPaths(child, newPath+"/")...)
 	}
 	return paths
 }
@@ -103,7 +359,7 @@ func (t *HybridTrie) getAllPaths(node *TrieNode, currentPath string) []string {
 const MaxFilesToPrint = 25
 
 func (t *HybridTrie) PrintTrie() {
-	t.printHelper(&t.Root, "")
+	t.printHelper(t.root(), "")
 }
 
 func (t *HybridTrie) printHelper(node *TrieNode, indent string) {
@@ -111,8 +367,8 @@ func (t *HybridTrie) printHelper(node *TrieNode, indent string) {
 		log.Println(indent + "Large directory ")
 		return
 	}
-	for part, child := range node.Children {
-		log.Println(indent + part)
+	for key, child := range node.Children {
+		log.Println(indent + child.label(key))
 		if child.IsEndOfWord {
 			log.Println(indent + "└── *")
 		}
@@ -120,51 +376,100 @@ func (t *HybridTrie) printHelper(node *TrieNode, indent string) {
 	}
 }
 
+// Prune drops empty branches and merges chains of nodes that are neither
+// files nor branches into single edges. AddPath and the removal functions
+// keep the trie compressed on their own, Prune is only needed for tries
+// built some other way.
 func (t *HybridTrie) Prune() {
-	t.pruneHelper(&t.Root)
+	t.pruneHelper(t.root())
 }
 
 func (t *HybridTrie) pruneHelper(node *TrieNode) {
-	for part, child := range node.Children {
-		// If the child is not the end of a word and has only one child,
-		// merge the child with its child.
-		if !child.IsEndOfWord && len(child.Children) == 1 {
-			for childPart, grandChild := range child.Children {
-				// Remove the child from the node's children.
-				delete(node.Children, part)
-				// Add the grandchild to the node's children, with the merged parts.
-				node.Children[part+childPart] = grandChild
-				// Continue pruning from the grandchild.
-				t.pruneHelper(grandChild)
-				break
-			}
-		} else {
-			// Continue pruning from the child.
-			t.pruneHelper(child)
-		}
+	// Prune from the bottom up, so that a child is compacted once everything
+	// below it is, and dropping an empty branch lets its parent merge too.
+	for key, child := range node.Children {
+		t.pruneHelper(child)
+		t.compact(node, key)
 	}
 }
 
-func (t *HybridTrie) SaveToFile(filename string) error {
-	t.Prune()
-	file, err := os.Create(filename)
+// Supported on-disk index formats.
+const (
+	FormatGob   = "gob"
+	FormatProto = "proto"
+	FormatFlat  = "flat"
+)
+
+// indexExtension returns the file extension used for an index saved in the given format.
+func indexExtension(format string) string {
+	switch format {
+	case FormatProto:
+		return "pb"
+	case FormatFlat:
+		return "idx"
+	default:
+		return "gob"
+	}
+}
+
+// SaveToFile writes the trie to filename. The index is written to a temporary
+// file first and renamed into place, so readers never see a partial index.
+func (t *HybridTrie) SaveToFile(filename, format string) error {
+	tmpName := filename + ".tmp"
+	file, err := os.Create(tmpName)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer os.Remove(tmpName)
 
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
+	err = t.encode(file, format)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
 
-	encoder := gob.NewEncoder(gw)
-	err = encoder.Encode(t)
+func (t *HybridTrie) encode(w io.Writer, format string) error {
+	if format == FormatFlat {
+		return writeFlatIndex(t, bufio.NewWriter(w))
+	}
+
+	gw := gzip.NewWriter(w)
+
+	var err error
+	switch format {
+	case FormatGob:
+		encoder := gob.NewEncoder(gw)
+		err = encoder.Encode(t)
+	case FormatProto:
+		var data []byte
+		data, err = proto.Marshal(t)
+		if err == nil {
+			_, err = gw.Write(data)
+		}
+	default:
+		err = fmt.Errorf("unknown index format: %s", format)
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+	return gw.Close()
 }
 
-func (t *HybridTrie) LoadFromFile(filename string) error {
+func (t *HybridTrie) LoadFromFile(filename, format string) error {
+	if format == FormatFlat {
+		f, err := OpenFlatIndex(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		f.toTrie(t)
+		return nil
+	}
+
 	file, err := os.Open(filename)
 	if err != nil {
 		return err
@@ -177,8 +482,19 @@ func (t *HybridTrie) LoadFromFile(filename string) error {
 	}
 	defer gr.Close()
 
-	decoder := gob.NewDecoder(gr)
-	err = decoder.Decode(t)
+	switch format {
+	case FormatGob:
+		decoder := gob.NewDecoder(gr)
+		err = decoder.Decode(t)
+	case FormatProto:
+		var data []byte
+		data, err = io.ReadAll(gr)
+		if err == nil {
+			err = proto.Unmarshal(data, t)
+		}
+	default:
+		err = fmt.Errorf("unknown index format: %s", format)
+	}
 	if err != nil {
 		return err
 	}
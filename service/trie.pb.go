@@ -25,8 +25,21 @@ type TrieNode struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	IsEndOfWord bool                 `protobuf:"varint,2,opt,name=IsEndOfWord,proto3" json:"IsEndOfWord,omitempty"`
-	Children    map[string]*TrieNode `protobuf:"bytes,3,rep,name=Children,proto3" json:"Children,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	IsEndOfWord bool `protobuf:"varint,2,opt,name=IsEndOfWord,proto3" json:"IsEndOfWord,omitempty"`
+	// Children are keyed by the first path segment of the edge leading to them.
+	Children map[string]*TrieNode `protobuf:"bytes,3,rep,name=Children,proto3" json:"Children,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// Every segment of a compressed edge leading to this node, including the
+	// first one. Empty when the edge is a single segment.
+	Segments []string `protobuf:"bytes,4,rep,name=Segments,proto3" json:"Segments,omitempty"`
+	// The normalized name of this node used by exact search. Empty when it is
+	// the same as the last segment.
+	Key string `protobuf:"bytes,5,opt,name=Key,proto3" json:"Key,omitempty"`
+	// Modification time of the file in Unix seconds, 0 when unknown.
+	ModTime int64 `protobuf:"varint,6,opt,name=ModTime,proto3" json:"ModTime,omitempty"`
+	// Size of the file in bytes.
+	Size int64 `protobuf:"varint,7,opt,name=Size,proto3" json:"Size,omitempty"`
+	// Target of a symbolic link recorded as a link, empty for other files.
+	Link string `protobuf:"bytes,8,opt,name=Link,proto3" json:"Link,omitempty"`
 }
 
 func (x *TrieNode) Reset() {
@@ -75,12 +88,50 @@ func (x *TrieNode) GetChildren() map[string]*TrieNode {
 	return nil
 }
 
+func (x *TrieNode) GetSegments() []string {
+	if x != nil {
+		return x.Segments
+	}
+	return nil
+}
+
+func (x *TrieNode) GetKey() string {
+	if x != nil {
+		return x.Key
+	}
+	return ""
+}
+
+func (x *TrieNode) GetModTime() int64 {
+	if x != nil {
+		return x.ModTime
+	}
+	return 0
+}
+
+func (x *TrieNode) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *TrieNode) GetLink() string {
+	if x != nil {
+		return x.Link
+	}
+	return ""
+}
+
 type HybridTrie struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Root TrieNode `protobuf:"bytes,1,opt,name=Root,proto3" json:"Root,omitempty"`
+	Root *TrieNode `protobuf:"bytes,1,opt,name=Root,proto3" json:"Root,omitempty"`
+	// How names were normalized when the trie was built.
+	IgnoreCase    bool   `protobuf:"varint,2,opt,name=IgnoreCase,proto3" json:"IgnoreCase,omitempty"`
+	Normalization string `protobuf:"bytes,3,opt,name=Normalization,proto3" json:"Normalization,omitempty"`
 }
 
 func (x *HybridTrie) Reset() {
@@ -117,30 +168,55 @@ func (*HybridTrie) Descriptor() ([]byte, []int) {
 
 func (x *HybridTrie) GetRoot() *TrieNode {
 	if x != nil {
-		return &x.Root
+		return x.Root
 	}
 	return nil
 }
 
+func (x *HybridTrie) GetIgnoreCase() bool {
+	if x != nil {
+		return x.IgnoreCase
+	}
+	return false
+}
+
+func (x *HybridTrie) GetNormalization() string {
+	if x != nil {
+		return x.Normalization
+	}
+	return ""
+}
+
 var File_trie_proto protoreflect.FileDescriptor
 
 var file_trie_proto_rawDesc = []byte{
-	0x0a, 0x0a, 0x74, 0x72, 0x69, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0xa9, 0x01, 0x0a,
+	0x0a, 0x0a, 0x74, 0x72, 0x69, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x99, 0x02, 0x0a,
 	0x08, 0x54, 0x72, 0x69, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x12, 0x20, 0x0a, 0x0b, 0x49, 0x73, 0x45,
 	0x6e, 0x64, 0x4f, 0x66, 0x57, 0x6f, 0x72, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0b,
 	0x49, 0x73, 0x45, 0x6e, 0x64, 0x4f, 0x66, 0x57, 0x6f, 0x72, 0x64, 0x12, 0x33, 0x0a, 0x08, 0x43,
 	0x68, 0x69, 0x6c, 0x64, 0x72, 0x65, 0x6e, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x17, 0x2e,
 	0x54, 0x72, 0x69, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x2e, 0x43, 0x68, 0x69, 0x6c, 0x64, 0x72, 0x65,
 	0x6e, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x08, 0x43, 0x68, 0x69, 0x6c, 0x64, 0x72, 0x65, 0x6e,
+	0x12, 0x1a, 0x0a, 0x08, 0x53, 0x65, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x18, 0x04, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x08, 0x53, 0x65, 0x67, 0x6d, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x10, 0x0a, 0x03,
+	0x4b, 0x65, 0x79, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x4b, 0x65, 0x79, 0x12, 0x18,
+	0x0a, 0x07, 0x4d, 0x6f, 0x64, 0x54, 0x69, 0x6d, 0x65, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x07, 0x4d, 0x6f, 0x64, 0x54, 0x69, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x53, 0x69, 0x7a, 0x65,
+	0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x04, 0x53, 0x69, 0x7a, 0x65, 0x12, 0x12, 0x0a, 0x04,
+	0x4c, 0x69, 0x6e, 0x6b, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x4c, 0x69, 0x6e, 0x6b,
 	0x1a, 0x46, 0x0a, 0x0d, 0x43, 0x68, 0x69, 0x6c, 0x64, 0x72, 0x65, 0x6e, 0x45, 0x6e, 0x74, 0x72,
 	0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03,
 	0x6b, 0x65, 0x79, 0x12, 0x1f, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01,
 	0x28, 0x0b, 0x32, 0x09, 0x2e, 0x54, 0x72, 0x69, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x52, 0x05, 0x76,
-	0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x2b, 0x0a, 0x0a, 0x48, 0x79, 0x62, 0x72,
+	0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x71, 0x0a, 0x0a, 0x48, 0x79, 0x62, 0x72,
 	0x69, 0x64, 0x54, 0x72, 0x69, 0x65, 0x12, 0x1d, 0x0a, 0x04, 0x52, 0x6f, 0x6f, 0x74, 0x18, 0x01,
 	0x20, 0x01, 0x28, 0x0b, 0x32, 0x09, 0x2e, 0x54, 0x72, 0x69, 0x65, 0x4e, 0x6f, 0x64, 0x65, 0x52,
-	0x04, 0x52, 0x6f, 0x6f, 0x74, 0x42, 0x03, 0x5a, 0x01, 0x2e, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74,
-	0x6f, 0x33,
+	0x04, 0x52, 0x6f, 0x6f, 0x74, 0x12, 0x1e, 0x0a, 0x0a, 0x49, 0x67, 0x6e, 0x6f, 0x72, 0x65, 0x43,
+	0x61, 0x73, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x0a, 0x49, 0x67, 0x6e, 0x6f, 0x72,
+	0x65, 0x43, 0x61, 0x73, 0x65, 0x12, 0x24, 0x0a, 0x0d, 0x4e, 0x6f, 0x72, 0x6d, 0x61, 0x6c, 0x69,
+	0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0d, 0x4e, 0x6f,
+	0x72, 0x6d, 0x61, 0x6c, 0x69, 0x7a, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x42, 0x08, 0x5a, 0x06, 0x2e,
+	0x3b, 0x6d, 0x61, 0x69, 0x6e, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
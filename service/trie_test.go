@@ -0,0 +1,232 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// trieShape describes the edges of a trie, with a * after every file and the
+// children of a node in parentheses, so tests can check how edges are split
+// and merged.
+func trieShape(t *HybridTrie) string {
+	var shape func(n *TrieNode) string
+	shape = func(n *TrieNode) string {
+		var edges []string
+		for key, child := range n.Children {
+			edge := child.label(key)
+			if child.IsEndOfWord {
+				edge += "*"
+			}
+			if len(child.Children) > 0 {
+				edge += "(" + shape(child) + ")"
+			}
+			edges = append(edges, edge)
+		}
+		sort.Strings(edges)
+		return strings.Join(edges, " ")
+	}
+	return shape(t.root())
+}
+
+// trieWith returns a trie holding paths.
+func trieWith(paths ...string) *HybridTrie {
+	var trie HybridTrie
+	for _, path := range paths {
+		trie.AddPath(path)
+	}
+	return &trie
+}
+
+func TestTrieInsert(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"/a/b/c.txt"}, "/a/b/c.txt*"},
+		{[]string{"/a/b/c.txt", "/a/b/d.txt"}, "/a/b(c.txt* d.txt*)"},
+		{[]string{"/a/b/c.txt", "/a/x"}, "/a(b/c.txt* x*)"},
+		{[]string{"/a/b/c.txt", "/a/b"}, "/a/b*(c.txt*)"},
+		{[]string{"/a/b", "/a/b/c.txt"}, "/a/b*(c.txt*)"},
+		{[]string{"/a/b/c.txt", "/a/b/c.txt"}, "/a/b/c.txt*"},
+		{[]string{"/a/b/c/d.txt", "/a/b/e/f.txt", "/x.txt"}, "(a/b(c/d.txt* e/f.txt*) x.txt*)"},
+		{[]string{`C:\Users\me\a.txt`, "C:/Users/me/b.txt"}, "C:/Users/me(a.txt* b.txt*)"},
+	}
+	for _, test := range tests {
+		trie := trieWith(test.paths...)
+		if got := trieShape(trie); got != test.want {
+			t.Errorf("%q: shape = %s, want %s", test.paths, got, test.want)
+		}
+	}
+}
+
+func TestTrieSearchAfterReload(t *testing.T) {
+	paths := []string{
+		"/src/app/main.go",
+		"/src/app/Main.go",
+		"/src/app/internal/util/strings.go",
+		"/src/lib/main.go",
+		"/docs/README.md",
+	}
+	trie := NewHybridTrie(NameOptions{IgnoreCase: true})
+	for _, path := range paths {
+		trie.AddPath(path)
+	}
+	shape := trieShape(trie)
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"main.go", []string{"/src/app/Main.go", "/src/app/main.go", "/src/lib/main.go"}},
+		{"STRINGS.GO", []string{"/src/app/internal/util/strings.go"}},
+		{"readme.md", []string{"/docs/README.md"}},
+		{"util", nil},
+	}
+	for _, format := range []string{FormatGob, FormatProto, FormatFlat} {
+		filename := filepath.Join(t.TempDir(), "trie."+indexExtension(format))
+		if err := trie.SaveToFile(filename, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		var loaded HybridTrie
+		if err := loaded.LoadFromFile(filename, format); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if got := trieShape(&loaded); got != shape {
+			t.Errorf("%s: shape = %s, want %s", format, got, shape)
+		}
+		for _, test := range tests {
+			got := loaded.Search(test.name)
+			sort.Strings(got)
+			if len(got) == 0 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: Search(%q) = %q, want %q", format, test.name, got, test.want)
+			}
+		}
+
+		// A loaded trie is split like one that was never saved.
+		loaded.AddPath("/src/app/internal/x.go")
+		want := trieShape(trieWith(append(paths, "/src/app/internal/x.go")...))
+		if got := trieShape(&loaded); got != want {
+			t.Errorf("%s: shape after adding = %s, want %s", format, got, want)
+		}
+	}
+}
+
+// uncompressedTrie returns a trie with one node for every segment of paths.
+// Paths ending with a slash are directories without files.
+func uncompressedTrie(paths ...string) *HybridTrie {
+	trie := &HybridTrie{}
+	for _, path := range paths {
+		node := trie.root()
+		parts := splitPath(strings.TrimSuffix(path, "/"))
+		for _, part := range parts {
+			child, ok := node.Children[part]
+			if !ok {
+				child = &TrieNode{Children: make(map[string]*TrieNode)}
+				node.Children[part] = child
+			}
+			node = child
+		}
+		node.IsEndOfWord = node.IsEndOfWord || !strings.HasSuffix(path, "/")
+	}
+	return trie
+}
+
+func TestTriePrune(t *testing.T) {
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"/a/b/c.txt"}, "/a/b/c.txt*"},
+		{[]string{"/a/b/c.txt", "/a/d.txt"}, "/a(b/c.txt* d.txt*)"},
+		{[]string{"/a/b/c.txt", "/a/empty/"}, "/a/b/c.txt*"},
+		{[]string{"/a/b/c.txt", "/a/b", "/a/e/f/"}, "/a/b*(c.txt*)"},
+		{[]string{"/a/empty/", "/b/"}, ""},
+	}
+	for _, test := range tests {
+		trie := uncompressedTrie(test.paths...)
+		trie.Prune()
+		if got := trieShape(trie); got != test.want {
+			t.Errorf("%q: shape = %s, want %s", test.paths, got, test.want)
+		}
+	}
+}
+
+func TestTrieRemoveRename(t *testing.T) {
+	tests := []struct {
+		name    string
+		paths   []string
+		change  func(trie *HybridTrie) error
+		want    string
+		wantErr bool
+	}{
+		{"remove merges the edge", []string{"/a/b/c.txt", "/a/b/d.txt"},
+			func(trie *HybridTrie) error { return trie.RemovePath("/a/b/d.txt") }, "/a/b/c.txt*", false},
+		{"remove drops empty dirs", []string{"/a/b/c/d.txt", "/a/x.txt", "/a/y.txt"},
+			func(trie *HybridTrie) error { return trie.RemovePath("/a/b/c/d.txt") }, "/a(x.txt* y.txt*)", false},
+		{"remove keeps a dir that is a file", []string{"/a/b", "/a/b/c.txt"},
+			func(trie *HybridTrie) error { return trie.RemovePath("/a/b/c.txt") }, "/a/b*", false},
+		{"remove a missing file", []string{"/a/b/c.txt"},
+			func(trie *HybridTrie) error { return trie.RemovePath("/a/b/d.txt") }, "/a/b/c.txt*", true},
+		{"remove a dir as a file", []string{"/a/b/c.txt", "/a/b/d.txt"},
+			func(trie *HybridTrie) error { return trie.RemovePath("/a/b") }, "/a/b(c.txt* d.txt*)", true},
+		{"remove inside an edge", []string{"/a/b/c.txt"},
+			func(trie *HybridTrie) error { return trie.RemovePath("/a/b") }, "/a/b/c.txt*", true},
+		{"remove tree", []string{"/a/b/c.txt", "/a/b/d.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RemoveTree("/a/b") }, "/a/x.txt*", false},
+		{"remove tree with a slash", []string{"/a/b/c.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RemoveTree("/a/b/") }, "/a/x.txt*", false},
+		{"remove tree inside an edge", []string{"/a/b/c/d.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RemoveTree("/a/b") }, "/a/x.txt*", false},
+		{"remove tree of a prefix name", []string{"/a/b/c.txt", "/a/bc/d.txt"},
+			func(trie *HybridTrie) error { return trie.RemoveTree("/a/b") }, "/a/bc/d.txt*", false},
+		{"remove a missing tree", []string{"/a/b/c.txt"},
+			func(trie *HybridTrie) error { return trie.RemoveTree("/a/x") }, "/a/b/c.txt*", true},
+		{"rename a file", []string{"/a/b.txt", "/a/c/d.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/b.txt", "/a/c/b.txt") }, "/a/c(b.txt* d.txt*)", false},
+		{"rename a dir", []string{"/a/b/c.txt", "/a/b/d.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/b", "/e") }, "(a/x.txt* e(c.txt* d.txt*))", false},
+		{"rename inside an edge", []string{"/a/b/c/d.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/b", "/a/y") }, "/a(x.txt* y/c/d.txt*)", false},
+		{"rename to a new edge", []string{"/a/b/c/d.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/b/c", "/f/g") }, "(a/x.txt* f/g/d.txt*)", false},
+		{"rename onto a path", []string{"/a/b.txt", "/a/c.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/b.txt", "/a/c.txt") }, "/a(b.txt* c.txt*)", true},
+		{"rename into itself", []string{"/a/b/c.txt", "/a/x.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/b", "/a/b/d") }, "/a(b/c.txt* x.txt*)", true},
+		{"rename a missing path", []string{"/a/b.txt"},
+			func(trie *HybridTrie) error { return trie.RenamePath("/a/c.txt", "/a/d.txt") }, "/a/b.txt*", true},
+	}
+	for _, test := range tests {
+		trie := trieWith(test.paths...)
+		err := test.change(trie)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: err = %v, want error %v", test.name, err, test.wantErr)
+		}
+		if got := trieShape(trie); got != test.want {
+			t.Errorf("%s: shape = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestTrieRenameKeepsMetadata(t *testing.T) {
+	trie := NewHybridTrie(NameOptions{IgnoreCase: true})
+	for _, info := range queryTestFiles {
+		trie.AddFile(info.name, info)
+	}
+	if err := trie.RenamePath("/src/vendor", "/src/third_party"); err != nil {
+		t.Fatal(err)
+	}
+	node, ok := trie.find("/src/third_party/lib/lib.go")
+	if !ok || node.Size != 40<<10 {
+		t.Fatalf("renamed file = %+v, %v", node, ok)
+	}
+	if got := trie.Search("LICENSE"); !reflect.DeepEqual(got, []string{"/src/third_party/lib/LICENSE"}) {
+		t.Errorf("Search after rename = %q", got)
+	}
+}
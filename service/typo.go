@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+)
+
+// SearchTypo finds names within a maximum edit distance of the query.
+const SearchTypo = "typo"
+
+// DefaultMaxDistance is used by typo search when the request does not set one.
+const DefaultMaxDistance = 2
+
+// TypoMatch is a typo search result. Distance is the number of single
+// character insertions, deletions, substitutions or transpositions between
+// the query and the file name, so lower is better and 0 is an exact match.
+type TypoMatch struct {
+	Path     string
+	Distance int
+}
+
+// editDistance returns the Damerau-Levenshtein distance between a and b:
+// the Levenshtein distance with transpositions of adjacent characters
+// counting as a single edit. Unlike the restricted variant it is a metric,
+// which the BK-tree relies on.
+func editDistance(a, b []rune) int {
+	maxDist := len(a) + len(b)
+	d := make([][]int, len(a)+2)
+	for i := range d {
+		d[i] = make([]int, len(b)+2)
+	}
+	d[0][0] = maxDist
+	for i := 0; i <= len(a); i++ {
+		d[i+1][0] = maxDist
+		d[i+1][1] = i
+	}
+	for j := 0; j <= len(b); j++ {
+		d[0][j+1] = maxDist
+		d[1][j+1] = j
+	}
+
+	// The last row where each character of a was seen.
+	lastRow := make(map[rune]int)
+	for i := 1; i <= len(a); i++ {
+		// The last column in this row where a[i-1] matched.
+		lastMatch := 0
+		for j := 1; j <= len(b); j++ {
+			k := lastRow[b[j-1]]
+			l := lastMatch
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+				lastMatch = j
+			}
+			d[i+1][j+1] = min(
+				d[i][j]+cost,              // substitution
+				d[i+1][j]+1,               // insertion
+				d[i][j+1]+1,               // deletion
+				d[k][l]+(i-k-1)+1+(j-l-1), // transposition
+			)
+		}
+		lastRow[a[i-1]] = i
+	}
+	return d[len(a)+1][len(b)+1]
+}
+
+// bkTree indexes strings by edit distance. Every child of a node is stored
+// under its distance to that node, so by the triangle inequality a search
+// only has to visit children whose distance is close to the query's.
+type bkTree struct {
+	nodes []bkNode
+}
+
+type bkNode struct {
+	id       uint32
+	word     []rune
+	children map[int]int
+}
+
+func newBKTree(words []string) *bkTree {
+	t := &bkTree{nodes: make([]bkNode, 0, len(words))}
+	for id, word := range words {
+		t.add(uint32(id), []rune(word))
+	}
+	return t
+}
+
+func (t *bkTree) add(id uint32, word []rune) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, bkNode{id: id, word: word})
+		return
+	}
+
+	n := 0
+	for {
+		d := editDistance(t.nodes[n].word, word)
+		child, ok := t.nodes[n].children[d]
+		if !ok {
+			if t.nodes[n].children == nil {
+				t.nodes[n].children = make(map[int]int)
+			}
+			t.nodes[n].children[d] = len(t.nodes)
+			t.nodes = append(t.nodes, bkNode{id: id, word: word})
+			return
+		}
+		n = child
+	}
+}
+
+type bkResult struct {
+	id       uint32
+	distance int
+}
+
+// find returns the ids of all words within maxDistance of query.
+func (t *bkTree) find(query string, maxDistance int) []bkResult {
+	if len(t.nodes) == 0 {
+		return nil
+	}
+
+	q := []rune(query)
+	var results []bkResult
+	stack := []int{0}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		d := editDistance(t.nodes[n].word, q)
+		if d <= maxDistance {
+			results = append(results, bkResult{id: t.nodes[n].id, distance: d})
+		}
+		for cd, child := range t.nodes[n].children {
+			if cd >= d-maxDistance && cd <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+	return results
+}
+
+// FindTypos returns the files whose name is within maxDistance edits of
+// query, closest first.
+func (idx *NameIndex) FindTypos(query string, maxDistance, max int) []TypoMatch {
+	idx.bkOnce.Do(func() {
+		idx.bk = newBKTree(idx.Keys)
+	})
+
+	found := idx.bk.find(idx.Options.Key(query), maxDistance)
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance != found[j].distance {
+			return found[i].distance < found[j].distance
+		}
+		return found[i].id < found[j].id
+	})
+
+	results := []TypoMatch{}
+	for _, r := range found {
+		for _, file := range idx.Files[r.id] {
+			if max > 0 && len(results) >= max {
+				return results
+			}
+			results = append(results, TypoMatch{Path: idx.Dirs[file.Dir] + file.Name, Distance: r.distance})
+		}
+	}
+	return results
+}
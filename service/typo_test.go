@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"config.yaml", "config.yaml", 0},
+		{"kitten", "sitting", 3},
+		{"cnofig.yaml", "config.yaml", 1},
+		{"mian.go", "main.go", 1},
+		{"ab", "ba", 1},
+		{"abcd", "badc", 2},
+		// Characters may be edited again after a transposition, which the
+		// restricted distance counts as 3.
+		{"CA", "ABC", 2},
+		{"héllo", "hlélo", 1},
+	}
+	for _, test := range tests {
+		if got := editDistance([]rune(test.a), []rune(test.b)); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := editDistance([]rune(test.b), []rune(test.a)); got != test.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestFindTypos(t *testing.T) {
+	idx := nameTestIndex(t, 1<<20, nameTestPaths)
+	tests := []struct {
+		query       string
+		maxDistance int
+		want        []TypoMatch
+	}{
+		{"mian.go", 0, []TypoMatch{}},
+		{"mian.go", 1, []TypoMatch{
+			{Path: "/docs/MAIN.go", Distance: 1},
+			{Path: "/src/app/main.go", Distance: 1},
+		}},
+		{"MAIN.GO", 0, []TypoMatch{
+			{Path: "/docs/MAIN.go", Distance: 0},
+			{Path: "/src/app/main.go", Distance: 0},
+		}},
+		{"raedme.md", 2, []TypoMatch{{Path: "/src/app/README.md", Distance: 1}}},
+		{"ba", 2, []TypoMatch{{Path: "/x/ab", Distance: 1}}},
+		{"domian.og", 1, []TypoMatch{}},
+		{"domian.og", 2, []TypoMatch{{Path: "/src/lib/domain.go", Distance: 2}}},
+		// Closest first, then in key order.
+		{"doman.go", 3, []TypoMatch{
+			{Path: "/src/lib/domain.go", Distance: 1},
+			{Path: "/docs/MAIN.go", Distance: 3},
+			{Path: "/src/app/main.go", Distance: 3},
+		}},
+	}
+	for _, test := range tests {
+		got := idx.FindTypos(test.query, test.maxDistance, 0)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("FindTypos(%q, %d) = %+v, want %+v", test.query, test.maxDistance, got, test.want)
+		}
+	}
+
+	if got := idx.FindTypos("doman.go", 3, 2); len(got) != 2 || got[0].Distance != 1 {
+		t.Errorf("FindTypos with max 2 = %+v", got)
+	}
+}
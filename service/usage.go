@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DirUsage is the disk usage of everything below a directory, from the sizes
+// stored in the index.
+type DirUsage struct {
+	Path  string
+	Files int
+	Bytes int64
+	// The largest files anywhere below the directory.
+	Largest []FileUsage
+	// Usage by file extension, largest first.
+	Extensions []ExtUsage
+	// The largest subdirectories, down to the requested depth.
+	Children []DirUsage `json:",omitempty"`
+}
+
+type FileUsage struct {
+	Path string
+	Size int64
+}
+
+// ExtUsage is the usage of the files with one extension. Files without an
+// extension have an empty Ext.
+type ExtUsage struct {
+	Ext   string
+	Files int
+	Bytes int64
+}
+
+// usageTotals adds up the files below a directory while walking the index.
+type usageTotals struct {
+	files   int
+	bytes   int64
+	exts    map[string]*ExtUsage
+	largest []FileUsage
+}
+
+func (u *usageTotals) addFile(filePath string, size int64) {
+	u.files++
+	u.bytes += size
+	u.largest = append(u.largest, FileUsage{Path: filePath, Size: size})
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filePath), "."))
+	if u.exts == nil {
+		u.exts = make(map[string]*ExtUsage)
+	}
+	e, ok := u.exts[ext]
+	if !ok {
+		e = &ExtUsage{Ext: ext}
+		u.exts[ext] = e
+	}
+	e.Files++
+	e.Bytes += size
+}
+
+func (u *usageTotals) merge(other usageTotals) {
+	u.files += other.files
+	u.bytes += other.bytes
+	u.largest = append(u.largest, other.largest...)
+	if u.exts == nil {
+		u.exts = make(map[string]*ExtUsage)
+	}
+	for ext, o := range other.exts {
+		e, ok := u.exts[ext]
+		if !ok {
+			e = &ExtUsage{Ext: ext}
+			u.exts[ext] = e
+		}
+		e.Files += o.Files
+		e.Bytes += o.Bytes
+	}
+}
+
+// usageBuilder builds the usage report of a subtree of the index, keeping
+// the top entries of every list.
+type usageBuilder struct {
+	top int
+}
+
+// trim keeps only the largest files, so merging stays cheap.
+func (b *usageBuilder) trim(u *usageTotals) {
+	sort.Slice(u.largest, func(i, j int) bool {
+		if u.largest[i].Size != u.largest[j].Size {
+			return u.largest[i].Size > u.largest[j].Size
+		}
+		return u.largest[i].Path < u.largest[j].Path
+	})
+	if len(u.largest) > b.top {
+		u.largest = u.largest[:b.top]
+	}
+}
+
+func (b *usageBuilder) report(dirPath string, u usageTotals, children []DirUsage) DirUsage {
+	if dirPath == "" {
+		dirPath = "/"
+	}
+	d := DirUsage{
+		Path:       dirPath,
+		Files:      u.files,
+		Bytes:      u.bytes,
+		Largest:    append([]FileUsage{}, u.largest...),
+		Extensions: []ExtUsage{},
+	}
+	for _, e := range u.exts {
+		d.Extensions = append(d.Extensions, *e)
+	}
+	sort.Slice(d.Extensions, func(i, j int) bool {
+		if d.Extensions[i].Bytes != d.Extensions[j].Bytes {
+			return d.Extensions[i].Bytes > d.Extensions[j].Bytes
+		}
+		return d.Extensions[i].Ext < d.Extensions[j].Ext
+	})
+	if len(d.Extensions) > b.top {
+		d.Extensions = d.Extensions[:b.top]
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		if children[i].Bytes != children[j].Bytes {
+			return children[i].Bytes > children[j].Bytes
+		}
+		return children[i].Path < children[j].Path
+	})
+	if len(children) > b.top {
+		children = children[:b.top]
+	}
+	d.Children = children
+	return d
+}
+
+// dir returns the usage of the directory dirPath, whose contents are the
+// children of node, listing subdirectories down to depth levels. Children
+// are found under childPrefix, which is empty for the root of the trie.
+// Below the requested depth only the totals are returned.
+func (b *usageBuilder) dir(dirPath, childPrefix string, node *TrieNode, depth int) (*DirUsage, usageTotals) {
+	var u usageTotals
+	if node.IsEndOfWord {
+		u.addFile(dirPath, node.Size)
+	}
+	var children []DirUsage
+	for key, child := range node.Children {
+		edge := child.edge(key)
+		if dirPath == "" && edge[0] == "" {
+			// Absolute paths start with an empty segment, which is the
+			// same directory as the root of the trie.
+			sub, su := b.entry(childPrefix, edge, child, depth)
+			u.merge(su)
+			if sub != nil {
+				children = append(children, sub.Children...)
+			}
+			b.trim(&u)
+			continue
+		}
+		sub, su := b.entry(childPrefix, edge, child, depth-1)
+		u.merge(su)
+		if sub != nil && depth > 0 {
+			children = append(children, *sub)
+		}
+		b.trim(&u)
+	}
+	if depth < 0 {
+		return nil, u
+	}
+	d := b.report(dirPath, u, children)
+	return &d, u
+}
+
+// entry returns the usage of the entry reached by following edge from prefix
+// to node. Every segment of a compressed edge but the last is a directory.
+// The returned usage is nil when the entry is a single file or below the
+// requested depth.
+func (b *usageBuilder) entry(prefix string, edge []string, node *TrieNode, depth int) (*DirUsage, usageTotals) {
+	entryPath := prefix + edge[0]
+	if len(edge) > 1 {
+		sub, u := b.entry(entryPath+"/", edge[1:], node, depth-1)
+		if depth < 0 {
+			return nil, u
+		}
+		var children []DirUsage
+		if sub != nil {
+			children = append(children, *sub)
+		}
+		d := b.report(entryPath, u, children)
+		return &d, u
+	}
+	if len(node.Children) == 0 {
+		var u usageTotals
+		u.addFile(entryPath, node.Size)
+		return nil, u
+	}
+	return b.dir(entryPath, entryPath+"/", node, depth)
+}
+
+// Usage returns the disk usage below dir, or of the whole index if dir is
+// empty, with the top largest files, extensions and subdirectories of every
+// directory down to depth levels.
+func (t *HybridTrie) Usage(dir string, depth, top int) (DirUsage, error) {
+	b := &usageBuilder{top: top}
+	depth = max(depth, 0)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		d, _ := b.dir("", "", t.root(), depth)
+		return *d, nil
+	}
+
+	steps, inside, ok := t.locate(splitPath(dir))
+	if !ok {
+		return DirUsage{}, fmt.Errorf("%s is not indexed: %w", dir, os.ErrNotExist)
+	}
+	// Follow the edge from the segment that dir ends with.
+	last := steps[len(steps)-1]
+	edge := last.node.edge(last.key)
+	if inside > 0 {
+		edge = edge[inside-1:]
+	} else {
+		edge = edge[len(edge)-1:]
+	}
+	d, u := b.entry(dir[:strings.LastIndex(dir, "/")+1], edge, last.node, depth)
+	if d == nil {
+		// dir is a single file.
+		return b.report(dir, u, nil), nil
+	}
+	return *d, nil
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -38,46 +40,139 @@ func YesNoPrompt(label string, def bool) bool {
 	}
 }
 
-func tryKillDaemon(port int) {
-	serverAddr := fmt.Sprintf("localhost:%d", port)
+// stopTimeout is how long stopDaemon waits for the daemon to exit before
+// killing it. The daemon itself gives up on running jobs earlier.
+const stopTimeout = shutdownTimeout + 10*time.Second
 
-	conn, err := net.Dial("tcp", serverAddr)
+// errNotRunning is returned when there is no daemon to stop.
+var errNotRunning = errors.New("vfmpd is not running")
+
+// pidFile returns the path of the PID file written by the daemon.
+func pidFile(cfg *ConfigDatabase) string {
+	return filepath.Join(cfg.Data.Dir, "vfmpd.pid")
+}
+
+// readPidFile returns the PID in the PID file.
+func readPidFile(filename string) (int, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Printf("Failed to connect to server: %v\n", err)
-		return
+		return 0, err
 	}
-	defer conn.Close()
-
-	// Set a timeout for the connection
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
 
-	// Send kill message
-	message := IPCMessage{
-		Type: "kill",
-		Data: "Daemon restart",
+// isDaemonProcess reports whether the process with the PID is a vfmpd
+// daemon and not another process that was given the PID of an old one.
+// Without /proc the PID is trusted.
+func isDaemonProcess(pid int) bool {
+	if _, err := os.Stat("/proc/self/cmdline"); err != nil {
+		return processAlive(pid)
 	}
-	jsonMessage, err := json.Marshal(message)
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
 	if err != nil {
-		fmt.Printf("Failed to marshal message: %v\n", err)
-		return
+		return false
 	}
+	name, _, _ := strings.Cut(string(cmdline), "\x00")
+	return name == daemonArgs[0]
+}
 
-	// Write the json + "\n" to the server
-	_, err = conn.Write(append(jsonMessage, '\n'))
-	if err != nil {
-		fmt.Printf("Failed to send message to server: %v\n", err)
-		return
+// findDaemon returns the PID of the running daemon from its PID file. A PID
+// file left behind by a daemon that is no longer running is removed.
+func findDaemon(cfg *ConfigDatabase) (int, bool) {
+	filename := pidFile(cfg)
+	pid, err := readPidFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false
+	}
+	if err == nil && pidFileLocked(filename) && isDaemonProcess(pid) {
+		return pid, true
+	}
+
+	log.Print("Removing stale PID file ", filename)
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		log.Print("Unable to remove the PID file: ", err)
+	}
+	return 0, false
+}
+
+// waitFor calls done until it returns true or timeout passes, and reports
+// whether it returned true.
+func waitFor(done func() bool, interval, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(interval)
 	}
+	return true
+}
 
-	// Relaunch the current process
-	args := os.Args
-	executable, err := os.Executable()
+// sendKill asks the daemon on port to stop gracefully.
+func sendKill(port int, reason string) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", port), 3*time.Second)
 	if err != nil {
-		log.Fatalf("Failed to get executable path: %v", err)
+		return err
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
 
-	err = syscall.Exec(executable, args, os.Environ())
+	jsonMessage, err := json.Marshal(IPCMessage{
+		Type: "kill",
+		Data: reason,
+	})
 	if err != nil {
-		log.Fatalf("Failed to relaunch process: %v", err)
+		return err
+	}
+	_, err = conn.Write(append(jsonMessage, '\n'))
+	return err
+}
+
+// stopDaemon stops the running daemon and waits for it to exit. A daemon
+// that does not exit within stopTimeout is killed. Without a PID file, as
+// when running in the foreground, it waits for the port to close instead.
+func stopDaemon(cfg *ConfigDatabase) error {
+	pid, hasPid := findDaemon(cfg)
+	port := strconv.Itoa(cfg.Server.Port)
+	if !hasPid && !tryConnect(port) {
+		return errNotRunning
+	}
+
+	if err := sendKill(cfg.Server.Port, "stop requested"); err != nil {
+		if !hasPid {
+			return fmt.Errorf("unable to send the kill message: %w", err)
+		}
+		log.Print("Unable to send the kill message, sending SIGTERM: ", err)
+		if err := terminateProcess(pid); err != nil {
+			return fmt.Errorf("unable to stop vfmpd (pid %d): %w", pid, err)
+		}
+	}
+
+	if !hasPid {
+		if !waitFor(func() bool { return !tryConnect(port) }, 500*time.Millisecond, stopTimeout) {
+			return fmt.Errorf("vfmpd did not stop within %s", stopTimeout)
+		}
+		return nil
+	}
+
+	log.Printf("Waiting for vfmpd (pid %d) to stop", pid)
+	// The lock is released as soon as the daemon exits, even before its
+	// parent has reaped it.
+	stopped := func() bool { return !processAlive(pid) || !pidFileLocked(pidFile(cfg)) }
+	if waitFor(stopped, 100*time.Millisecond, stopTimeout) {
+		return nil
+	}
+
+	log.Printf("vfmpd did not stop within %s, killing it", stopTimeout)
+	if err := killProcess(pid); err != nil {
+		return fmt.Errorf("unable to kill vfmpd (pid %d): %w", pid, err)
+	}
+	if !waitFor(stopped, 100*time.Millisecond, 5*time.Second) {
+		return fmt.Errorf("vfmpd (pid %d) is still running after SIGKILL", pid)
+	}
+	// A killed daemon leaves its PID file behind.
+	if err := os.Remove(pidFile(cfg)); err != nil && !os.IsNotExist(err) {
+		log.Print("Unable to remove the PID file: ", err)
 	}
+	return nil
 }
@@ -1,48 +1,92 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
-	"syscall"
 	"time"
 
 	"github.com/sevlyar/go-daemon"
+	"golang.org/x/term"
 )
 
 func main() {
+	var startOpts startOptions
 	startCommand := flag.NewFlagSet("start", flag.ExitOnError)
+	startOpts.register(startCommand)
 	stopCommand := flag.NewFlagSet("stop", flag.ExitOnError)
 	restartCommand := flag.NewFlagSet("restart", flag.ExitOnError)
 	statusCommand := flag.NewFlagSet("status", flag.ExitOnError)
+	benchCommand := flag.NewFlagSet("bench", flag.ExitOnError)
+	benchRounds := benchCommand.Int("rounds", 3, "number of save/load rounds per format")
+	runCommand := flag.NewFlagSet("run", flag.ExitOnError)
+	runForeground := runCommand.Bool("foreground", false, "stay in the foreground and log to stderr, for systemd")
+	startOpts.register(runCommand)
+	installCommand := flag.NewFlagSet("install-service", flag.ExitOnError)
+	installDir := installCommand.String("dir", "/etc/systemd/system", "directory to write the units to, - to print them")
+	installSocket := installCommand.Bool("socket", false, "also write a socket unit, so systemd starts vfmpd on the first connection")
+	configCommands := []*flag.FlagSet{startCommand, runCommand, installCommand, stopCommand, restartCommand, statusCommand}
+	for _, fs := range configCommands {
+		registerConfigFlags(fs)
+	}
+
+	// The flags are parsed first, since they override the config.
+	for _, fs := range append(configCommands, benchCommand) {
+		if len(os.Args) >= 2 && os.Args[1] == fs.Name() {
+			fs.Parse(os.Args[2:])
+		}
+	}
 
 	cfg := ConfigDatabase{}
 	loadConfig(&cfg)
 
 	if len(os.Args) < 2 {
-		startDaemon(&cfg)
+		startDaemon(&cfg, startOpts)
 	} else {
 		switch os.Args[1] {
 		case "start":
-			startCommand.Parse(os.Args[2:])
-			startDaemon(&cfg)
+			startDaemon(&cfg, startOpts)
+		case "run":
+			if *runForeground {
+				runInForeground(&cfg)
+			} else {
+				startDaemon(&cfg, startOpts)
+			}
+		case "install-service":
+			if err := installService(&cfg, *installDir, *installSocket); err != nil {
+				log.Fatal("Unable to install the service: ", err)
+			}
 		case "stop":
-			stopCommand.Parse(os.Args[2:])
-			tryKillDaemon(cfg.Server.Port)
+			err := stopDaemon(&cfg)
+			if errors.Is(err, errNotRunning) {
+				log.Print(err)
+			} else if err != nil {
+				log.Fatal("Unable to stop vfmpd: ", err)
+			} else {
+				log.Print("vfmpd stopped")
+			}
 		case "restart":
-			restartCommand.Parse(os.Args[2:])
-			tryKillDaemon(cfg.Server.Port)
-			startDaemon(&cfg)
+			err := stopDaemon(&cfg)
+			if err != nil && !errors.Is(err, errNotRunning) {
+				log.Fatal("Unable to stop vfmpd: ", err)
+			}
+			startDaemon(&cfg, startOpts)
 		case "status":
-			statusCommand.Parse(os.Args[2:])
-			if tryConnect(strconv.Itoa(cfg.Server.Port)) {
-				log.Print("vfmpd is running")
-			} else {
-				log.Print("vfmpd is not running")
+			printStatus(&cfg)
+		case "bench":
+			if benchCommand.NArg() != 1 {
+				log.Fatal("Usage: vfmpd bench [-rounds n] <directory>")
+			}
+			if *benchRounds < 1 {
+				log.Fatal("-rounds must be at least 1")
 			}
+			benchFormats(benchCommand.Arg(0), *benchRounds)
 		default:
 			log.Fatal("Unknown command")
 		}
@@ -50,25 +94,15 @@ func main() {
 }
 
 func loadConfig(cfg *ConfigDatabase) {
-	configDir, err := os.UserConfigDir()
+	configFile, err := findConfigFile()
 	if err != nil {
-		log.Print("Error getting user config directory:", err)
-		return
+		log.Fatal("Unable to find a place for the config file: ", err)
 	}
-	log.Print("User config directory:", configDir)
-
-	vfmpDir := filepath.Join(configDir, "vfmp")
-	if _, err := os.Stat(vfmpDir); os.IsNotExist(err) {
-		log.Print("vfmp config directory does not exist, creating a new one")
-		err = os.Mkdir(vfmpDir, 0755)
-		if err != nil {
-			log.Fatal("Unable to create vfmp config directory:", err)
-		}
-	}
-
-	configFile := filepath.Join(vfmpDir, "config.yaml")
 	log.Print("Config file:", configFile)
 
+	// The daemon process reads the same file, from the data directory.
+	os.Setenv("VFMP_CONFIG", configFile)
+	configPath = configFile
 	ProcessConfig(configFile, cfg)
 }
 
@@ -81,7 +115,7 @@ func tryConnect(port string) bool {
 	return true
 }
 
-func startDaemon(cfg *ConfigDatabase) {
+func ensureDataDir(cfg *ConfigDatabase) {
 	if _, err := os.Stat(cfg.Data.Dir); os.IsNotExist(err) {
 		log.Print("vfmp data directory does not exist, creating a new one")
 		err = os.Mkdir(cfg.Data.Dir, 0755)
@@ -89,46 +123,68 @@ func startDaemon(cfg *ConfigDatabase) {
 			log.Fatal("Unable to create vfmp data directory:", err)
 		}
 	}
+}
 
-	pidFile := filepath.Join(cfg.Data.Dir, "vfmpd.pid")
-	if _, err := os.Stat(pidFile); err == nil {
-		is_running := false
-
-		data, err := os.ReadFile(pidFile)
-		if err != nil {
-			log.Fatal("Unable to read pid file:", err)
-		}
+// startOptions decide what starting does when the daemon is already
+// running.
+type startOptions struct {
+	// Stop the running daemon without asking
+	force bool
+	// Never ask, and leave the running daemon alone unless force is set
+	noPrompt bool
+}
 
-		pid, err := strconv.Atoi(string(data))
-		if err != nil {
-			log.Fatal("Unable to parse pid:", err)
-		}
+func (o *startOptions) register(fs *flag.FlagSet) {
+	fs.BoolVar(&o.force, "force", false, "stop a running daemon without asking")
+	fs.BoolVar(&o.noPrompt, "no-prompt", false, "never ask, leave a running daemon alone unless -force is given")
+}
 
-		p, err := os.FindProcess(pid)
+// daemonArgs are the arguments of the daemon process, which also tell it
+// apart from other processes.
+var daemonArgs = []string{"[vfmpd/daemon]"}
 
-		// On unix systems run p.Signal(syscall.Signal(0)) to check if the process is running
-		err = p.Signal(os.Signal(syscall.Signal(0)))
-		if err == nil {
-			is_running = true
-		}
+func startDaemon(cfg *ConfigDatabase, opts startOptions) {
+	ensureDataDir(cfg)
 
-		if is_running {
-			if YesNoPrompt("vfmpd is already running, would you like to kill it?", false) {
-				tryKillDaemon(cfg.Server.Port)
+	// The parent has already written the PID file of the daemon process.
+	if !daemon.WasReborn() {
+		pid, running := findDaemon(cfg)
+		// A daemon running in the foreground has no PID file.
+		running = running || tryConnect(strconv.Itoa(cfg.Server.Port))
+		if running {
+			if pid != 0 {
+				log.Printf("vfmpd is already running with pid %d", pid)
 			} else {
+				log.Printf("vfmpd is already running on port %d", cfg.Server.Port)
+			}
+			// Without a terminal, as in init scripts, there is nobody to ask.
+			if !opts.force && (opts.noPrompt || !term.IsTerminal(int(os.Stdin.Fd()))) {
+				return
+			}
+			if !opts.force && !YesNoPrompt("Would you like to stop it?", false) {
 				return
 			}
+			if err := stopDaemon(cfg); err != nil && !errors.Is(err, errNotRunning) {
+				log.Fatal("Unable to stop vfmpd: ", err)
+			}
 		}
 	}
 
+	// The daemon writes its own log, so this only catches what is written
+	// around it, like panics. The output of the previous start is kept.
+	outputFile := filepath.Join(cfg.Data.Dir, "vfmpd.out")
+	if !daemon.WasReborn() {
+		os.Rename(outputFile, outputFile+".1")
+	}
+
 	cntxt := &daemon.Context{
-		PidFileName: filepath.Join(cfg.Data.Dir, "vfmpd.pid"),
+		PidFileName: pidFile(cfg),
 		PidFilePerm: 0644,
-		LogFileName: filepath.Join(cfg.Data.Dir, "vfmpd.log"),
+		LogFileName: outputFile,
 		LogFilePerm: 0640,
 		WorkDir:     cfg.Data.Dir,
 		Umask:       027,
-		Args:        []string{"[vfmpd/daemon]"},
+		Args:        daemonArgs,
 	}
 
 	d, err := cntxt.Reborn()
@@ -136,12 +192,81 @@ func startDaemon(cfg *ConfigDatabase) {
 		log.Fatal("Unable to run: ", err)
 	}
 	if d != nil {
+		log.Printf("vfmpd started with pid %d", d.Pid)
 		return
 	}
-	defer cntxt.Release()
+	defer func() {
+		if err := cntxt.Release(); err != nil {
+			slog.Error("Unable to remove the PID file", "err", err)
+		}
+	}()
+
+	if err := setupLogging(cfg, nil); err != nil {
+		log.Fatal("Unable to open the log: ", err)
+	}
+	slog.Info("daemon started", "pid", os.Getpid(), "version", version)
+
+	serve(cfg)
+}
+
+// runInForeground runs the daemon without forking or writing a PID file,
+// logging to stderr, as expected by systemd and other supervisors.
+func runInForeground(cfg *ConfigDatabase) {
+	ensureDataDir(cfg)
+	if err := setupLogging(cfg, os.Stderr); err != nil {
+		log.Fatal("Unable to set up the log: ", err)
+	}
+	slog.Info("vfmpd started in the foreground", "pid", os.Getpid(), "version", version)
+
+	serve(cfg)
+}
 
-	log.Print("- - - - - - - - - - - - - - -")
-	log.Print("daemon started")
+// serve indexes the configured roots, starts the scheduler and answers
+// clients until the daemon is asked to stop, then stops gracefully.
+func serve(cfg *ConfigDatabase) {
+	daemonStarted = time.Now()
+	runningConfig.Store(cfg)
+	go handleSignals()
+	watchConfig()
+	goJob(func() { ensureRoots(cfg, jobLog(slog.Default(), "roots")) })
+
+	if err := startScheduler(cfg); err != nil {
+		log.Fatal("Unable to schedule indexing: ", err)
+	}
+	if cfg.Metrics.Enabled {
+		startMetricsServer(cfg)
+	}
 
 	setupIPCServer(cfg)
+	shutdown()
+}
+
+// startScheduler starts indexing the roots of cfg on their schedules. Every
+// run uses the config that is running when it starts.
+func startScheduler(cfg *ConfigDatabase) error {
+	scheduler := NewScheduler(scheduleStateFile(cfg), func(path string) error {
+		// A run is a job, so shutdown waits for it even once a reload
+		// replaced this scheduler.
+		if !startJob() {
+			return errShuttingDown
+		}
+		defer finishJob()
+		cfg := runningConfig.Load()
+		root, ok := findRoot(cfg, path)
+		if !ok {
+			return fmt.Errorf("%s is no longer a root", path)
+		}
+		timer := daemonMetrics.startJob("index.scheduled")
+		defer timer.done()
+		return indexRoot(root, cfg, jobLog(slog.Default(), "index.scheduled"), nil)
+	})
+	for _, root := range cfg.Roots {
+		err := scheduler.Add(root.Path, root.Schedule, time.Duration(cfg.Schedule.Jitter)*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	scheduler.Start()
+	indexScheduler.Store(scheduler)
+	return nil
 }
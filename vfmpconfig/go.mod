@@ -0,0 +1,5 @@
+module github.com/vyPal/VFMP/vfmpconfig
+
+go 1.18
+
+require gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,114 @@
+// Package vfmpconfig finds the config files of vfmpd and its clients.
+package vfmpconfig
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SystemFile is where vfmpd looks for its config first.
+const SystemFile = "/etc/vfmp/config.yaml"
+
+// DefaultAddress is where vfmpd listens unless configured otherwise.
+const DefaultAddress = "localhost:32768"
+
+// DaemonFiles returns where vfmpd looks for its config when none is given,
+// in order: SystemFile, then config.yaml in the vfmp directory of the user
+// config directory.
+func DaemonFiles() []string {
+	files := []string{SystemFile}
+	if configDir, err := os.UserConfigDir(); err == nil {
+		files = append(files, filepath.Join(configDir, "vfmp", "config.yaml"))
+	}
+	return files
+}
+
+// Client tells a client how to reach the daemon.
+type Client struct {
+	Server struct {
+		// host:port of the daemon
+		Address string `yaml:"address"`
+	} `yaml:"server"`
+}
+
+// ClientFile returns client.yaml in the vfmp directory of the user config
+// directory.
+func ClientFile() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "vfmp", "client.yaml"), nil
+}
+
+// LoadClient reads the client config from file, or from ClientFile when
+// file is empty. Without client.yaml the port is taken from the config of
+// the daemon on this machine, if it can be read, and the defaults are used
+// otherwise. $VFMP_PORT overrides the port, as it does for vfmpd.
+func LoadClient(file string) (Client, error) {
+	var config Client
+	config.Server.Address = DefaultAddress
+
+	explicit := file != ""
+	if !explicit {
+		// Without a user config directory there is no client.yaml either.
+		file, _ = ClientFile()
+	}
+
+	data, err := os.ReadFile(file)
+	switch {
+	case err == nil:
+		err = yaml.Unmarshal(data, &config)
+		if err != nil {
+			return config, fmt.Errorf("unable to parse %s: %w", file, err)
+		}
+	case explicit || !os.IsNotExist(err):
+		return config, err
+	default:
+		if port, ok := daemonPort(); ok {
+			config.Server.Address = net.JoinHostPort("localhost", strconv.Itoa(port))
+		}
+	}
+
+	host, _, err := net.SplitHostPort(config.Server.Address)
+	if err != nil {
+		return config, fmt.Errorf("server.address: %w", err)
+	}
+	if port := os.Getenv("VFMP_PORT"); port != "" {
+		if _, err := strconv.Atoi(port); err != nil {
+			return config, fmt.Errorf("invalid VFMP_PORT: %w", err)
+		}
+		config.Server.Address = net.JoinHostPort(host, port)
+	}
+	return config, nil
+}
+
+// daemonPort returns the port in the config of the daemon on this machine,
+// looked up the way vfmpd does.
+func daemonPort() (int, bool) {
+	files := DaemonFiles()
+	if file := os.Getenv("VFMP_CONFIG"); file != "" {
+		files = []string{file}
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		var daemonConfig struct {
+			Server struct {
+				Port int `yaml:"port"`
+			} `yaml:"server"`
+		}
+		// vfmpd uses the first file it finds.
+		err = yaml.Unmarshal(data, &daemonConfig)
+		return daemonConfig.Server.Port, err == nil && daemonConfig.Server.Port != 0
+	}
+	return 0, false
+}